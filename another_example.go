@@ -3,36 +3,168 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"math"
+	"math/rand"
+	"mime/multipart"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 // Pass token and sensible APIs through environment variables
 const telegramApiBaseUrl string = "https://api.telegram.org/bot"
 const telegramApiSendMessage string = "/sendMessage"
 const telegramTokenEnv string = "TELEGRAM_BOT_TOKEN"
+const telegramBotUsernameEnv string = "TELEGRAM_BOT_USERNAME"
 const telegramApiEditMessage string = "/editMessageText"
 const telegramSendLocationMessage string = "/sendLocation"
+const telegramSendPhotoMessage string = "/sendPhoto"
+const telegramSendDocumentMessage string = "/sendDocument"
+const telegramSendVoiceMessage string = "/sendVoice"
+const telegramSendVenueMessage string = "/sendVenue"
+const telegramSendContactMessage string = "/sendContact"
+const telegramSendPollMessage string = "/sendPoll"
+const telegramSendStickerMessage string = "/sendSticker"
+const telegramSendAudioMessage string = "/sendAudio"
+const telegramEditLiveLocationMessage string = "/editMessageLiveLocation"
+const telegramApiGetMe string = "/getMe"
+const telegramApiGetWebhookInfo string = "/getWebhookInfo"
 const ANTON_CHAT_ID int = 49208041
 
-var telegramApiSend string = telegramApiBaseUrl + os.Getenv(telegramTokenEnv) + telegramApiSendMessage
-var telegramApiEdit string = telegramApiBaseUrl + os.Getenv(telegramTokenEnv) + telegramApiEditMessage
-var telegramApiSendLocation string = telegramApiBaseUrl + os.Getenv(telegramTokenEnv) + telegramSendLocationMessage
+// Error rate alerting is tuned through environment variables as well
+const errorAlertThresholdEnv string = "ERROR_ALERT_THRESHOLD"
+const errorAlertWindowEnv string = "ERROR_ALERT_WINDOW"
+const errorAlertMuteEnv string = "ERROR_ALERT_MUTE"
+const errorAlertMinUpdates int = 5
+
+const wrongPasswordNotifyEnv string = "WRONG_PASSWORD_NOTIFY"
+const rawCaptureEnv string = "RAW_CAPTURE"
+const adminLanguageEnv string = "ADMIN_LANGUAGE"
+const chatLockTimeoutEnv string = "CHAT_LOCK_TIMEOUT"
+const staticMapUrlEnv string = "STATIC_MAP_URL_TEMPLATE"
+const rawNotifyMaxLength int = 1000
+const logDebugEnv string = "LOG_DEBUG"
+const logBodyMaxLengthEnv string = "LOG_BODY_MAX_LENGTH"
+const telegramRetryAttemptsEnv string = "TELEGRAM_RETRY_ATTEMPTS"
+const telegramTimeoutEnv string = "TELEGRAM_TIMEOUT"
+const callCaptureSizeEnv string = "CALL_CAPTURE_SIZE"
+const adminLiveLocationEnv string = "ADMIN_LIVE_LOCATION"
+const adminLivePeriodEnv string = "ADMIN_LIVE_PERIOD"
+const liveLocationEditInterval time.Duration = 15 * time.Second
+const alertWebhookUrlEnv string = "ALERT_WEBHOOK_URL"
+const tokenRetryInterval time.Duration = time.Minute
+const tokenAlertInterval time.Duration = time.Hour
+const minLocationSeparationEnv string = "MIN_LOCATION_SEPARATION"
+const maxRevealOverlapEnv string = "MAX_REVEAL_OVERLAP"
+const alertEventsEnv string = "ALERT_EVENTS"
+const alertEmailApiUrlEnv string = "ALERT_EMAIL_API_URL"
+const alertEmailApiKeyEnv string = "ALERT_EMAIL_API_KEY"
+const alertEmailFromEnv string = "ALERT_EMAIL_FROM"
+const alertEmailToEnv string = "ALERT_EMAIL_TO"
+const alertAttempts int = 3
+const alertBackoff time.Duration = time.Second
+const alertBudget time.Duration = 10 * time.Second
+const updateIdToleranceEnv string = "UPDATE_ID_TOLERANCE"
+const maxMessageAgeEnv string = "MAX_MESSAGE_AGE"
+const diagBudgetEnv string = "DIAG_BUDGET"
+const questTimezoneEnv string = "QUEST_TIMEZONE"
+const diagCheckTimeout time.Duration = 3 * time.Second
+const callCaptureBodyMaxLength int = 512
+const sendBudgetEnv string = "SEND_BUDGET"
+const sendBudgetWarnEnv string = "SEND_BUDGET_WARN"
+const emergencySecretEnv string = "EMERGENCY_SECRET"
+const emergencySecretHeader string = "X-Emergency-Secret"
+
+var telegramBotUsername string = os.Getenv(telegramBotUsernameEnv)
+var wrongPasswordNotify string = os.Getenv(wrongPasswordNotifyEnv)
+var rawCapture bool = os.Getenv(rawCaptureEnv) == "true"
+var adminLanguage string = os.Getenv(adminLanguageEnv)
+var chatLockTimeout time.Duration = envDuration(chatLockTimeoutEnv, 10*time.Second)
+
+// staticMapUrl is a static map image URL with {lat}, {lon} and {zoom} placeholders, e.g.
+// https://staticmap.openstreetmap.de/staticmap.php?center={lat},{lon}&zoom={zoom}&size=600x400&markers={lat},{lon},red-pushpin
+// Map previews are skipped when it is not set.
+var staticMapUrl string = os.Getenv(staticMapUrlEnv)
+var logDebug bool = os.Getenv(logDebugEnv) == "true"
+var logBodyMaxLength int = envInt(logBodyMaxLengthEnv, 1024)
+var lastCalls = newCallCapture(envInt(callCaptureSizeEnv, 20))
+
+// When adminLiveLocation is on, the location pings of every player are mirrored to the admin chat as a live location,
+// valid for adminLivePeriod (Telegram accepts 1 minute to 24 hours).
+var adminLiveLocation bool = os.Getenv(adminLiveLocationEnv) == "true"
+var adminLivePeriod time.Duration = envDuration(adminLivePeriodEnv, time.Hour)
+
+// alertWebhookUrl is an incoming webhook (Google Chat, Slack) taking {"text": ...}, used when the bot token itself is
+// rejected and the admin chat can't be reached.
+var alertWebhookUrl string = os.Getenv(alertWebhookUrlEnv)
+
+// emergencySecret guards HandleEmergencySend, which is disabled unless it is set.
+var emergencySecret string = os.Getenv(emergencySecretEnv)
 
 // Update is a Telegram object that we receive every time an user interacts with the bot.
 type Update struct {
 	UpdateId int     `json:"update_id"`
 	Message  Message `json:"message"`
 	CallbackQuerry CallbackQuerry `json:"callback_query"`
+	PollAnswer PollAnswer `json:"poll_answer"`
+
+	// raw is the original JSON of the update, only kept in raw capture mode
+	raw json.RawMessage
+}
+
+// Raw returns the original JSON of the update, or nil when raw capture mode is off.
+func (u Update) Raw() json.RawMessage {
+	return u.raw
+}
+
+// GetRawPath looks up a dot separated path like "message.from.language_code" in the original JSON of the update, with
+// numeric segments indexing arrays. It returns false when raw capture is off or the path doesn't exist.
+func (u Update) GetRawPath(path string) (interface{}, bool) {
+	if u.raw == nil {
+		return nil, false
+	}
+	var node interface{}
+	if err := json.Unmarshal(u.raw, &node); err != nil {
+		return nil, false
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[key]
+			if !ok {
+				return nil, false
+			}
+			node = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
 }
 
 // Implements the fmt.String interface to get the representation of an Update as a string.
@@ -45,30 +177,96 @@ func hsin(theta float64) float64 {
 	return math.Pow(math.Sin(theta/2), 2)
 }
 
-// Distance function returns the distance (in meters) between two points of
-//     a given longitude and latitude relatively accurately (using a spherical
-//     approximation of the Earth) through the Haversin Distance Formula for
-//     great arc distance on a sphere with accuracy for small distances
-//
-// point coordinates are supplied in degrees and converted into rad. in the func
-//
-// distance returned is METERS!!!!!!
+// Geodesic measures the distance in METERS between two points given in degrees.
+type Geodesic interface {
+	Distance(l1, l2 Location) float64
+}
+
+// Haversine is the great arc distance on a sphere of the given Radius, accurate for small distances.
 // http://en.wikipedia.org/wiki/Haversine_formula
-func Distance(l1, l2 Location) float64 {
+type Haversine struct {
+	Radius float64
+}
+
+func (g Haversine) Distance(l1, l2 Location) float64 {
 	// convert to radians
-  // must cast radius as float to multiply later
-	var la1, lo1, la2, lo2, r float64
+	var la1, lo1, la2, lo2 float64
 	la1 = l1.Latitude * math.Pi / 180
 	lo1 = l1.Longitude * math.Pi / 180
 	la2 = l2.Latitude * math.Pi / 180
 	lo2 = l2.Longitude * math.Pi / 180
 
-	r = 6378100 // Earth radius in METERS
-
 	// calculate
 	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
 
-	return 2 * r * math.Asin(math.Sqrt(h))
+	return 2 * g.Radius * math.Asin(math.Sqrt(h))
+}
+
+// Ellipsoidal is the distance on the WGS-84 ellipsoid using Vincenty's inverse formula. It falls back to the mean
+// radius haversine for nearly antipodal points where the iteration doesn't converge.
+// https://en.wikipedia.org/wiki/Vincenty%27s_formulae
+type Ellipsoidal struct{}
+
+func (g Ellipsoidal) Distance(l1, l2 Location) float64 {
+	const a = 6378137.0
+	const f = 1 / 298.257223563
+	const b = a * (1 - f)
+
+	L := (l2.Longitude - l1.Longitude) * math.Pi / 180
+	U1 := math.Atan((1 - f) * math.Tan(l1.Latitude*math.Pi/180))
+	U2 := math.Atan((1 - f) * math.Tan(l2.Latitude*math.Pi/180))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma := math.Sqrt(math.Pow(cosU2*sinLambda, 2) + math.Pow(cosU1*sinU2-sinU1*cosU2*cosLambda, 2))
+		if sinSigma == 0 {
+			return 0 // same point
+		}
+		cosSigma := sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma := math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha := 1 - sinAlpha*sinAlpha
+		cos2SigmaM := 0.0
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := f / 16 * cosSqAlpha * (4 + f*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = L + (1-C)*f*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-previous) < 1e-12 {
+			uSq := cosSqAlpha * (a*a - b*b) / (b * b)
+			A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+			B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+			deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+			return b * A * (sigma - deltaSigma)
+		}
+	}
+	return MeanHaversine.Distance(l1, l2)
+}
+
+// EquatorialHaversine uses the equatorial Earth radius, as Distance always did. MeanHaversine uses the mean radius,
+// which is closer on average.
+var EquatorialHaversine Geodesic = Haversine{Radius: 6378100}
+var MeanHaversine Geodesic = Haversine{Radius: 6371008.8}
+
+// GEODESIC is how this quest measures distances.
+var GEODESIC Geodesic = EquatorialHaversine
+
+// Distance function returns the distance (in meters) between two points using the configured GEODESIC.
+func Distance(l1, l2 Location) float64 {
+	return GEODESIC.Distance(l1, l2)
+}
+
+// nearestDistance returns the distance from l to the closest of LOCATIONS.
+func nearestDistance(g Geodesic, l Location) float64 {
+	nearest := math.Inf(1)
+	for _, clue := range LOCATIONS {
+		nearest = math.Min(nearest, g.Distance(clue, l))
+	}
+	return nearest
 }
 
 // Message is a Telegram object that can be found in an update.
@@ -79,8 +277,23 @@ type Message struct {
 	Chat     Chat     `json:"chat"`
 	Audio    Audio    `json:"audio"`
 	Voice    Voice    `json:"voice"`
+	Sticker  Sticker  `json:"sticker"`
 	Document Document `json:"document"`
 	Location Location `json:"location"`
+	Date     int64    `json:"date"`
+	Entities []MessageEntity `json:"entities"`
+}
+
+// MessageEntity marks a special part of a message text, e.g. a bot_command. Offset and Length are in UTF-16 units.
+// The optional fields are kept so an entity can be sent back as it was received.
+type MessageEntity struct {
+	Type          string `json:"type"`
+	Offset        int    `json:"offset"`
+	Length        int    `json:"length"`
+	URL           string `json:"url,omitempty"`
+	User          *User  `json:"user,omitempty"`
+	Language      string `json:"language,omitempty"`
+	CustomEmojiId string `json:"custom_emoji_id,omitempty"`
 }
 
 type CallbackQuerry struct {
@@ -95,6 +308,14 @@ func (c CallbackQuerry) String() string {
 	return fmt.Sprintf("(id: %d, message: %s, data: %s, from: %s)", c.Id, c.Message, c.Data, c.From)
 }
 
+// PollAnswer is a vote in a non-anonymous poll sent by the bot. It carries no chat, the user id is the chat id of
+// private chats.
+type PollAnswer struct {
+	PollId    string `json:"poll_id"`
+	User      User   `json:"user"`
+	OptionIds []int  `json:"option_ids"`
+}
+
 type User struct {
 	Id int64 `json:"id"`
 	Username string `json:"username"`
@@ -102,7 +323,7 @@ type User struct {
 
 // Implements the fmt.String interface to get the representation of a Message as a string.
 func (m Message) String() string {
-	return fmt.Sprintf("(text: %s, chat: %s, audio %s)", m.Text, m.Chat, m.Audio)
+	return fmt.Sprintf("(text: %s, chat: %s, audio %s)", maskText(m.Text), m.Chat, m.Audio)
 }
 
 // Audio message has extra attributes
@@ -119,6 +340,12 @@ func (a Audio) String() string {
 // Voice Message can be summarized with similar attribute as an Audio message for our use case.
 type Voice Audio
 
+// Sticker is a sticker sent by the player, Emoji is the emoji it is associated with.
+type Sticker struct {
+	FileId string `json:"file_id"`
+	Emoji  string `json:"emoji"`
+}
+
 // Document Message refer to a file sent.
 type Document struct {
 	FileId   string `json:"file_id"`
@@ -130,6 +357,39 @@ func (d Document) String() string {
 	return fmt.Sprintf("(file id: %s, file name: %s)", d.FileId, d.FileName)
 }
 
+// APIResponse is the envelope Telegram wraps every answer in.
+type APIResponse struct {
+	Ok          bool            `json:"ok"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// TelegramError is an answer with ok=false, e.g. 403 "Forbidden: bot was blocked by the user".
+type TelegramError struct {
+	Code        int
+	Description string
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("telegram error %d: %s", e.Code, e.Description)
+}
+
+// apiError returns a *TelegramError if Telegram refused the call answered with body.
+func apiError(body []byte) error {
+	var response APIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("could not decode telegram response: %w", err)
+	}
+	if !response.Ok {
+		return &TelegramError{Code: response.ErrorCode, Description: response.Description}
+	}
+	return nil
+}
+
 // A Chat indicates the conversation to which the Message belongs.
 type Chat struct {
 	Id int `json:"id"`
@@ -139,6 +399,7 @@ type Chat struct {
 type Location struct {
 	Longitude float64 `json:"longitude"`
 	Latitude  float64 `json:"latitude"`
+	HorizontalAccuracy float64 `json:"horizontal_accuracy"`
 }
 
 // Implements the fmt.String interface to get the representation of a Chat as a string.
@@ -156,168 +417,4245 @@ var LOCATIONS = [...]Location {
 	Location {Latitude: 48.166302, Longitude: 11.568141}, // luitpold
 }
 
-func isAllowed(e string) bool {
-    for _, a := range ALLOWED_USERS {
-        if a == e {
-            return true
-        }
-    }
-    return false
+// Deep-link campaigns: a /start <code> payload from a t.me link maps to the campaign name reported to the admin.
+var CAMPAIGNS = map[string]string {
+	"munich": "Мюнхенский квест",
 }
 
-func to_lower_letters(s string) string {
-	ret := strings.ToLower(s);
-	return ret;
+// Referral payloads are the referrer's username with this prefix, e.g. /start ref_sonicfelidae
+const referralPrefix string = "ref_"
+
+// Telegram only allows these characters and up to 64 of them in a start parameter.
+var startPayloadPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// DistanceTier is the reply used when the nearest clue is closer than MaxDistance meters. Tiers that Reveal send the
+// coordinates of every clue within MaxDistance, each preceded by Text, also when a nearer tier matched.
+type DistanceTier struct {
+	MaxDistance float64
+	Text        string
+	Reveal      bool
 }
 
-// HandleTelegramWebHook sends a message back to the chat with a punchline starting by the message provided by the user.
-func HandleTelegramWebHook(w http.ResponseWriter, r *http.Request) {
+// DISTANCE_TIERS must be ordered by strictly increasing MaxDistance and end with a catch-all tier.
+var DISTANCE_TIERS = [...]DistanceTier {
+	DistanceTier {MaxDistance: 2000, Text: "Проверь это место", Reveal: true},
+	DistanceTier {MaxDistance: math.Inf(1), Text: "Вблизи нет подсказок"},
+}
 
-	// Parse incoming request
-	var update, err = parseTelegramRequest(r)
+func init() {
+	if err := validateDistanceTiers(DISTANCE_TIERS[:]); err != nil {
+		log.Fatalf("invalid distance tiers: %s", err.Error())
+	}
+}
+
+// validateDistanceTiers checks the tiers are strictly increasing and that the last one catches every distance.
+func validateDistanceTiers(tiers []DistanceTier) error {
+	if len(tiers) == 0 {
+		return errors.New("no distance tiers configured")
+	}
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].MaxDistance <= tiers[i-1].MaxDistance {
+			return fmt.Errorf("tier %d (%.0fm) is not farther than tier %d (%.0fm)", i, tiers[i].MaxDistance, i-1, tiers[i-1].MaxDistance)
+		}
+	}
+	if last := tiers[len(tiers)-1]; !math.IsInf(last.MaxDistance, 1) {
+		return fmt.Errorf("last tier ends at %.0fm, it must cover any distance", last.MaxDistance)
+	}
+	return nil
+}
+
+// A degree of latitude is at least this many meters long, used to skip pairs of locations that are obviously far apart.
+const minMetersPerDegreeLatitude float64 = 110000
+
+func init() {
+	minSeparation := envFloat(minLocationSeparationEnv, 50)
+	maxOverlap := envFloat(maxRevealOverlapEnv, 0.5)
+	warnings, err := checkLocations(GEODESIC, LOCATIONS[:], revealRadius(DISTANCE_TIERS[:]), minSeparation, maxOverlap)
 	if err != nil {
-		log.Printf("error parsing update, %s", err.Error())
-		return
+		log.Fatalf("invalid locations: %s", err.Error())
+	}
+	for _, warning := range warnings {
+		log.Printf("warning: %s", warning)
 	}
+}
 
-	if (!isAllowed(update.Message.Chat.Username)) {
-		return;
+// revealRadius is the largest distance at which a tier reveals clues.
+func revealRadius(tiers []DistanceTier) float64 {
+	radius := 0.0
+	for _, tier := range tiers {
+		if tier.Reveal && !math.IsInf(tier.MaxDistance, 1) && tier.MaxDistance > radius {
+			radius = tier.MaxDistance
+		}
+	}
+	return radius
+}
+
+// revealOverlap is the share of the reveal area of a location, a circle of the given radius, that is shared with the
+// one of a location at the given distance.
+func revealOverlap(distance float64, radius float64) float64 {
+	if radius <= 0 || distance >= 2*radius {
+		return 0
 	}
+	lens := 2*radius*radius*math.Acos(distance/(2*radius)) - distance/2*math.Sqrt(4*radius*radius-distance*distance)
+	return lens / (math.Pi * radius * radius)
+}
 
-	if (update.Message.Text == "/start") {
-		var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Присылай мне свою локацию. Если ты будешь относительно близко к расположению подсказки, я дам тебе точные координаты!\nУ меня есть так же команда /unlock =)")
-		sendTextMessage(ANTON_CHAT_ID, "Соня начала искать локации!")
-		if errTelegram != nil {
-			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
+// checkLocations returns an error for locations with the same coordinates, and warnings for locations closer than
+// minSeparation meters or whose reveal areas overlap by more than maxOverlap. Only pairs close enough in latitude to
+// matter are measured.
+func checkLocations(g Geodesic, locations []Location, radius float64, minSeparation float64, maxOverlap float64) ([]string, error) {
+	order := make([]int, len(locations))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return locations[order[a]].Latitude < locations[order[b]].Latitude
+	})
+	reach := math.Max(2*radius, minSeparation)
+	var warnings []string
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if (locations[j].Latitude-locations[i].Latitude)*minMetersPerDegreeLatitude > reach {
+				break
+			}
+			first, second := i, j
+			if second < first {
+				first, second = second, first
+			}
+			if locations[i] == locations[j] {
+				return nil, fmt.Errorf("locations %s and %s have the same coordinates", locationName(first), locationName(second))
+			}
+			distance := g.Distance(locations[i], locations[j])
+			if distance < minSeparation {
+				warnings = append(warnings, fmt.Sprintf("locations %s and %s are only %.0fm apart", locationName(first), locationName(second), distance))
+			}
+			if overlap := revealOverlap(distance, radius); overlap > maxOverlap {
+				warnings = append(warnings, fmt.Sprintf("reveal areas of locations %s and %s overlap by %.0f%%", locationName(first), locationName(second), overlap*100))
+			}
 		}
-	} else if (update.Message.Text == "/unlock") {
-		var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Пароль?")
-		if errTelegram != nil {
-			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+// pickDistanceTier returns the first tier the distance falls into.
+func pickDistanceTier(tiers []DistanceTier, distance float64) DistanceTier {
+	for _, tier := range tiers {
+		if distance < tier.MaxDistance {
+			return tier
 		}
-	} else if (to_lower_letters(update.Message.Text) == "afsio") {
-		var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Молодец! Все верно!\nВ качестве приза могли прийти, но не пришли:\n1. Поездка в Австрию на викенд. Но она почему-то вводит локдаун.\n2. Поход на Щелкунчика. Но кто-то прощелкал все полимеры =(.\n3. Карты с покемонами на испанском. Но они у тебя уже есть.\n\n\n\nНо зато пришел: бессрочный recharge day on demand. Предложение отвезти тебя, куда ты захочешь, на 1 день. Используй его, когда тебе вздумается.")
-		var telegramResponseBody2, errTelegram2 = sendTextMessage(ANTON_CHAT_ID, "Соня справилась!")
-		if errTelegram != nil {
-			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
+	}
+	return tiers[len(tiers)-1]
+}
+
+// pickRevealTier returns the closest reveal tier the distance falls into. A reveal reaches every distance below it,
+// so a nearer tier that doesn't reveal, e.g. <500m "очень горячо" before a <2000m reveal, only adds its text.
+func pickRevealTier(tiers []DistanceTier, distance float64) (DistanceTier, bool) {
+	for _, tier := range tiers {
+		if tier.Reveal && distance < tier.MaxDistance {
+			return tier, true
 		}
-		if errTelegram2 != nil {
-			log.Printf("got error %s from telegram, response body is %s", errTelegram2.Error(), telegramResponseBody2)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
+	}
+	return DistanceTier{}, false
+}
+
+// Zone is a named area the admin wants to hear about when the player enters or leaves it. Zones don't affect clues.
+type Zone struct {
+	Name              string
+	Center            Location
+	Radius            float64
+	NotifyTransitions bool
+}
+
+// ZONES, e.g. Zone {Name: "дом", Center: Location {Latitude: 48.1, Longitude: 11.5}, Radius: 300, NotifyTransitions: true}
+var ZONES = []Zone {}
+
+// zoneTracker remembers per chat whether the last ping was inside each zone. It lives as long as the warm instance.
+type zoneTracker struct {
+	mu     sync.Mutex
+	inside map[int]map[string]bool
+}
+
+var zones = &zoneTracker{inside: make(map[int]map[string]bool)}
+
+// zoneTransition is a zone the player entered or left.
+type zoneTransition struct {
+	Zone    string
+	Entered bool
+}
+
+// transitions updates the chat's position and returns every zone entered or left since the previous ping. The first
+// ping of a chat only sets the baseline.
+func (z *zoneTracker) transitions(g Geodesic, chatId int, l Location) []zoneTransition {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	previous, known := z.inside[chatId]
+	current := make(map[string]bool)
+	var transitions []zoneTransition
+	for _, zone := range ZONES {
+		if !zone.NotifyTransitions {
+			continue
 		}
-	} else if (update.Message.Location.Latitude > 0) {
-		found := false;
-		for t, l := range LOCATIONS {
-			if (Distance(l, update.Message.Location) < 2000) {
-				var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Проверь это место")
-				sendTextMessage(ANTON_CHAT_ID, fmt.Sprintf("Соня проверяет %d!", t))
-				if errTelegram != nil {
-					log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-				} else {
-					log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
-				}
-				telegramResponseBody, errTelegram = sendLocationMessage(update.Message.Chat.Id, l)
-				if errTelegram != nil {
-					log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-				} else {
-					log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
-				}
-				found = true;
-			}
+		current[zone.Name] = g.Distance(zone.Center, l) <= zone.Radius
+		if !known || current[zone.Name] == previous[zone.Name] {
+			continue
 		}
-		if (!found) {
-			var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Вблизи нет подсказок")
-			if errTelegram != nil {
-				log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-			} else {
-				log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
-			}
+		transitions = append(transitions, zoneTransition{Zone: zone.Name, Entered: current[zone.Name]})
+	}
+	z.inside[chatId] = current
+	return transitions
+}
+
+// PLAYER_NAMES is the registry of known players: username to the display name used in admin notifications. Players
+// missing here are shown as @username.
+var PLAYER_NAMES = map[string]string {
+	"antonhulikau": "Антон",
+	"sonicfelidae": "Соня",
+}
+
+// inviteRegistry holds the players who joined through a referral link, username to the username of the player who
+// invited them. It lives as long as the warm instance does.
+type inviteRegistry struct {
+	mu        sync.Mutex
+	referrers map[string]string
+}
+
+var invites = &inviteRegistry{referrers: make(map[string]string)}
+
+// add records the referral unless the user was invited already, the first referrer is kept. It reports whether the
+// referral was recorded.
+func (r *inviteRegistry) add(username string, referrer string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if username == "" || username == referrer {
+		return false
+	}
+	if _, ok := r.referrers[username]; ok {
+		return false
+	}
+	r.referrers[username] = referrer
+	return true
+}
+
+func (r *inviteRegistry) has(username string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.referrers[username]
+	return ok
+}
+
+// displayName is the registry name of the user, else @username, else empty which templates render with the "name"
+// placeholder.
+func displayName(username string) string {
+	if name, ok := PLAYER_NAMES[username]; ok {
+		return name
+	}
+	if username == "" {
+		return ""
+	}
+	return "@" + username
+}
+
+// mediaKind names what a message without text carries, for the "text" placeholder.
+func mediaKind(m Message) string {
+	switch {
+	case m.Voice.FileId != "":
+		return "voice"
+	case m.Audio.FileId != "":
+		return "audio"
+	case m.Document.FileId != "":
+		return "document"
+	case m.Sticker.FileId != "":
+		return "sticker"
+	case m.Location.Latitude != 0 || m.Location.Longitude != 0:
+		return "location"
+	}
+	return ""
+}
+
+// LOCATION_NAMES are the names of LOCATIONS, in the same order, used in admin notifications.
+var LOCATION_NAMES = [len(LOCATIONS)]string {"nyphemburg", "west", "ducks", "olympia", "luitpold"}
+
+func locationName(i int) string {
+	if i < len(LOCATION_NAMES) && LOCATION_NAMES[i] != "" {
+		return LOCATION_NAMES[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// LOCATION_HOURS are the opening hours of LOCATIONS, in the same order, empty for a location always open. Rules are
+// separated by ";", a date rule overrides the weekday rules of that day and a range may run past midnight, e.g.
+// "Mo-Fr 06:00-22:00; Sa,Su 06:00-01:00; 2026-12-24 closed; 2026-12-31 08:00-02:00"
+var LOCATION_HOURS = [len(LOCATIONS)]string {}
+
+// questTimezone is where the opening hours are, QUEST_TIMEZONE or Munich.
+var questTimezone *time.Location
+var locationHours [len(LOCATIONS)]*OpeningHours
+
+func init() {
+	name := os.Getenv(questTimezoneEnv)
+	if name == "" {
+		name = "Europe/Berlin"
+	}
+	var err error
+	if questTimezone, err = time.LoadLocation(name); err != nil {
+		log.Fatalf("invalid %s: %s", questTimezoneEnv, err.Error())
+	}
+	for i, spec := range LOCATION_HOURS {
+		if spec == "" {
+			continue
 		}
-	} else {
-		var telegramResponseBody, errTelegram = sendTextMessage(update.Message.Chat.Id, "Этот пароль не подходит =(")
-		sendTextMessage(ANTON_CHAT_ID, fmt.Sprintf("Соня ввела %s!", update.Message.Text))
-		if errTelegram != nil {
-			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
+		if locationHours[i], err = parseOpeningHours(spec); err != nil {
+			log.Fatalf("invalid opening hours of location %s: %s", locationName(i), err.Error())
 		}
 	}
-	log.Printf("Update new is %s", update);
 }
 
-// parseTelegramRequest handles incoming update from the Telegram web hook
-func parseTelegramRequest(r *http.Request) (*Update, error) {
-	var update Update
-	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		log.Printf("could not decode incoming update %s", err.Error())
-		return nil, err
+// LOCATION_INNER_RADII make finding LOCATIONS, in the same order, two-staged: within the reveal radius the player is
+// told to come closer, and the location is revealed within its inner radius. 0 keeps a single stage.
+var LOCATION_INNER_RADII = [len(LOCATIONS)]float64 {}
+
+func init() {
+	radius := revealRadius(DISTANCE_TIERS[:])
+	for i, inner := range LOCATION_INNER_RADII {
+		if inner < 0 || (inner > 0 && inner >= radius) {
+			log.Fatalf("inner radius %.0fm of location %s must be between 0 and the reveal radius %.0fm", inner, locationName(i), radius)
+		}
 	}
-	if update.UpdateId == 0 {
-		log.Printf("invalid update id, got update id = 0")
-		return nil, errors.New("invalid update id of 0 indicates failure to parse incoming update")
+}
+
+// nearMissRegistry remembers which locations the admin already heard about a near miss of each chat for. It lives as
+// long as the warm instance does, so after a cold start the admin may hear about it once more.
+type nearMissRegistry struct {
+	mu    sync.Mutex
+	chats map[int]map[int]bool
+}
+
+var nearMisses = &nearMissRegistry{chats: make(map[int]map[int]bool)}
+
+// first records a near miss of the location and tells whether it is the first one of the chat.
+func (r *nearMissRegistry) first(chatId int, location int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	locations := r.chats[chatId]
+	if locations == nil {
+		locations = make(map[int]bool)
+		r.chats[chatId] = locations
 	}
-	return &update, nil
+	if locations[location] {
+		return false
+	}
+	locations[location] = true
+	return true
 }
 
-// sendTextToTelegramChat sends an initial text message to the Telegram chat identified by its chat Id
-func sendTextMessage(chatId int, text string) (string, error) {
-	log.Printf("Sending start message to chat_id: %d", chatId);
+// LocationPhoto is a picture of the spot sent along with the coordinates of a location. Photo is a file_id, a URL or
+// the path of a file deployed with the function, e.g. "photos/olympia.jpg".
+type LocationPhoto struct {
+	Photo   string
+	Caption string
+}
 
-	response, err := http.PostForm(
-		telegramApiSend,
-		url.Values{
-			"chat_id": {strconv.Itoa(chatId)},
-			"text": {text},
-		},
-	)
-	if err != nil {
-		log.Printf("error when posting text to the chat: %s", err.Error())
-		return "", err
+// Venue labels the pin of a location with a title and an address.
+type Venue struct {
+	Title   string
+	Address string
+}
+
+// LOCATION_VENUES are the venues of LOCATIONS, in the same order. A location with a Title is sent as a venue, e.g.
+// Venue {Title: "Nymphenburg gate", Address: "Schloss Nymphenburg, München"}, any other as a bare location.
+var LOCATION_VENUES = [len(LOCATIONS)]Venue {}
+
+func init() {
+	for i, venue := range LOCATION_VENUES {
+		if (venue.Title == "") != (venue.Address == "") {
+			log.Fatalf("venue of location %s needs both a title and an address", locationName(i))
+		}
 	}
-	defer response.Body.Close()
-	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
-	if errRead != nil {
-		log.Printf("error in parsing telegram answer %s", errRead.Error())
-		return "", err
+}
+
+// Contact is a phone number shared as a contact card.
+type Contact struct {
+	Phone     string
+	FirstName string
+	LastName  string
+}
+
+// REPLY_STICKER is the file_id of the sticker the bot answers stickers with, a short text when empty. The file_id of
+// a sticker can be found in its update with RAW_CAPTURE on.
+var REPLY_STICKER string = ""
+
+// PRIZE_CONTACT is the contact the admin shares with a winner using /sharecontact, e.g. the prize hotline. Sharing is
+// off while Phone is empty.
+var PRIZE_CONTACT = Contact {}
+
+func init() {
+	if PRIZE_CONTACT.Phone != "" {
+		if err := checkContact(PRIZE_CONTACT.Phone, PRIZE_CONTACT.FirstName); err != nil {
+			log.Fatalf("invalid prize contact: %s", err.Error())
+		}
 	}
-	bodyString := string(bodyBytes)
-	log.Printf("Body of Telegram Response: %s", bodyString)
+}
 
-	return bodyString, nil
+// checkContact checks what Telegram requires of a contact.
+func checkContact(phone string, firstName string) error {
+	if strings.TrimSpace(phone) == "" {
+		return errors.New("contact has no phone number")
+	}
+	if strings.TrimSpace(firstName) == "" {
+		return errors.New("contact has no first name")
+	}
+	return nil
 }
 
-func sendLocationMessage(chatId int, l Location) (string, error) {
-	log.Printf("Sending location message to chat_id: %d", chatId);
+// LOCATION_PHOTOS are the photos of LOCATIONS, in the same order, with an empty Photo for a location without one.
+var LOCATION_PHOTOS = [len(LOCATIONS)]LocationPhoto {}
 
-	response, err := http.PostForm(
-		telegramApiSendLocation,
-		url.Values{
-			"chat_id": {strconv.Itoa(chatId)},
-			"longitude": {strconv.FormatFloat(l.Longitude, 'E', -1, 64)},
-			"latitude": {strconv.FormatFloat(l.Latitude, 'E', -1, 64)},
-			"horizontal_accuracy": {"2"},
-		},
-	)
+func init() {
+	for i, photo := range LOCATION_PHOTOS {
+		if err := checkCaption(photo.Caption); err != nil {
+			log.Fatalf("invalid photo of location %s: %s", locationName(i), err.Error())
+		}
+		if isLocalFile(photo.Photo) {
+			if _, err := os.Stat(photo.Photo); err != nil {
+				log.Fatalf("invalid photo of location %s: %s", locationName(i), err.Error())
+			}
+		}
+	}
+}
 
-	if err != nil {
-		log.Printf("error when posting text to the chat: %s", err.Error())
-		return "", err
+// isLocalFile tells a file path from a file_id, which never has a dot or a slash, or from a URL.
+func isLocalFile(photo string) bool {
+	return !strings.Contains(photo, "://") && strings.ContainsAny(photo, "./")
+}
+
+// hoursRange is an opening range in minutes since midnight. A range with to <= from closes on the next day.
+type hoursRange struct {
+	from int
+	to   int
+}
+
+// OpeningHours are the weekly opening hours of a location with exceptions for given dates.
+type OpeningHours struct {
+	weekdays [7][]hoursRange
+	dates    map[string][]hoursRange
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"Mo": time.Monday, "Tu": time.Tuesday, "We": time.Wednesday, "Th": time.Thursday, "Fr": time.Friday, "Sa": time.Saturday, "Su": time.Sunday,
+}
+
+// hoursRangePattern is the only form of an hours range, as Sscanf would accept trailing text or signed numbers.
+var hoursRangePattern = regexp.MustCompile(`^\d{2}:\d{2}-\d{2}:\d{2}$`)
+
+// parseOpeningHours parses rules like "Mo-Fr 06:00-22:00,23:00-01:00", "2026-12-24 closed" separated by ";".
+func parseOpeningHours(spec string) (*OpeningHours, error) {
+	h := &OpeningHours{dates: make(map[string][]hoursRange)}
+	for _, rule := range strings.Split(spec, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("rule %q is not \"<days> <hours>\"", strings.TrimSpace(rule))
+		}
+		var ranges []hoursRange
+		if fields[1] != "closed" {
+			for _, r := range strings.Split(fields[1], ",") {
+				var fromH, fromM, toH, toM int
+				if n, _ := fmt.Sscanf(r, "%d:%d-%d:%d", &fromH, &fromM, &toH, &toM); !hoursRangePattern.MatchString(r) || n != 4 || !validClock(fromH, fromM, false) || !validClock(toH, toM, true) {
+					return nil, fmt.Errorf("hours %q are not HH:MM-HH:MM", r)
+				}
+				ranges = append(ranges, hoursRange{from: fromH*60 + fromM, to: toH*60 + toM})
+			}
+		}
+		if _, err := time.Parse("2006-01-02", fields[0]); err == nil {
+			h.dates[fields[0]] = ranges
+			continue
+		}
+		for _, days := range strings.Split(fields[0], ",") {
+			first, last := days, days
+			if dash := strings.Index(days, "-"); dash >= 0 {
+				first, last = days[:dash], days[dash+1:]
+			}
+			from, ok1 := weekdayNames[first]
+			to, ok2 := weekdayNames[last]
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("days %q are neither weekdays like Mo-Fr nor a date", days)
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				h.weekdays[d] = append(h.weekdays[d], ranges...)
+				if d == to {
+					break
+				}
+			}
+		}
 	}
-	defer response.Body.Close()
-	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
-	if errRead != nil {
-		log.Printf("error in parsing telegram answer %s", errRead.Error())
-		return "", err
+	return h, nil
+}
+
+// validClock tells whether h:m is a time of day. 24:00 is accepted only as the end of a range.
+func validClock(h int, m int, end bool) bool {
+	if end && h == 24 && m == 0 {
+		return true
 	}
-	bodyString := string(bodyBytes)
-	log.Printf("Body of Telegram Response: %s", bodyString)
+	return h >= 0 && h <= 23 && m >= 0 && m <= 59
+}
+
+// rangesOn returns the ranges opening on the day of t.
+func (h *OpeningHours) rangesOn(t time.Time) []hoursRange {
+	if ranges, ok := h.dates[t.Format("2006-01-02")]; ok {
+		return ranges
+	}
+	return h.weekdays[t.Weekday()]
+}
+
+// Open tells whether the location is open at t, including ranges opened the day before and running past midnight.
+func (h *OpeningHours) Open(t time.Time) bool {
+	t = t.In(questTimezone)
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range h.rangesOn(t) {
+		if minute >= r.from && (minute < r.to || r.to <= r.from) {
+			return true
+		}
+	}
+	for _, r := range h.rangesOn(t.AddDate(0, 0, -1)) {
+		if r.to <= r.from && minute < r.to {
+			return true
+		}
+	}
+	return false
+}
 
-	return bodyString, nil
-}
\ No newline at end of file
+// NextOpening returns when the location opens next after t, looking up to a year ahead.
+func (h *OpeningHours) NextOpening(t time.Time) (time.Time, bool) {
+	t = t.In(questTimezone)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, questTimezone)
+	for offset := 0; offset <= 366; offset++ {
+		date := day.AddDate(0, 0, offset)
+		var next time.Time
+		for _, r := range h.rangesOn(date) {
+			start := date.Add(time.Duration(r.from) * time.Minute)
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// closedText tells the player when a closed location opens.
+func closedText(h *OpeningHours, now time.Time) string {
+	next, ok := h.NextOpening(now)
+	if !ok {
+		return "Это место сейчас закрыто"
+	}
+	now = now.In(questTimezone)
+	switch days := int(time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, questTimezone).Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, questTimezone)).Hours()+12) / 24; days {
+	case 0:
+		return "Это место сейчас закрыто, оно откроется сегодня в " + next.Format("15:04")
+	case 1:
+		return "Это место сейчас закрыто, оно откроется завтра в " + next.Format("15:04")
+	}
+	return "Это место сейчас закрыто, оно откроется " + next.Format("02.01 в 15:04")
+}
+
+// Admin notification events, the keys of the admin catalogs.
+const (
+	adminStarted       string = "started"
+	adminCompleted     string = "completed"
+	adminChecking      string = "checking"
+	adminWrongPassword string = "wrong_password"
+	adminZoneEntered   string = "zone_entered"
+	adminZoneLeft      string = "zone_left"
+	adminStranger      string = "stranger"
+	adminErrorSpike    string = "error_spike"
+	adminUpdateFailed  string = "update_failed"
+	adminMuted         string = "muted"
+	adminUnmuted       string = "unmuted"
+	adminUsage         string = "usage"
+	adminNoCalls       string = "no_calls"
+	adminMirror        string = "mirror"
+	adminTokenRejected string = "token_rejected"
+	adminNoTemplate    string = "no_template"
+	adminRenderError   string = "render_error"
+	adminClosed        string = "closed"
+	adminNearMiss      string = "near_miss"
+	adminEmergency     string = "emergency"
+	adminVoice         string = "voice"
+	adminAudio         string = "audio"
+	adminNoContact     string = "no_contact"
+	adminContactShared string = "contact_shared"
+	adminBudget        string = "budget"
+	adminBudgetWarning string = "budget_warning"
+	adminBudgetSpent   string = "budget_spent"
+	adminQuizCorrect   string = "quiz_correct"
+	adminQuizWrong     string = "quiz_wrong"
+	adminTransformed   string = "transformed"
+)
+
+var adminEvents = [...]string{adminStarted, adminCompleted, adminChecking, adminWrongPassword, adminZoneEntered, adminZoneLeft, adminStranger, adminErrorSpike, adminUpdateFailed, adminMuted, adminUnmuted, adminUsage, adminNoCalls, adminMirror, adminTokenRejected, adminNoTemplate, adminRenderError, adminClosed, adminNearMiss, adminEmergency, adminVoice, adminAudio, adminNoContact, adminContactShared, adminBudget, adminBudgetWarning, adminBudgetSpent, adminQuizCorrect, adminQuizWrong, adminTransformed}
+
+// adminData is what admin notification templates are rendered with. Each event only uses some of the fields.
+type adminData struct {
+	Player     string
+	ChatId     int
+	Location   string
+	Distance   float64
+	Text       string
+	Media      string
+	Zone       string
+	Referrer   string
+	Campaign   string
+	Count      int
+	Total      int
+	Suppressed int
+	Window     time.Duration
+	Errors     []string
+	UpdateId   int
+	Error      string
+	Transform  string
+}
+
+// ADMIN_TEXTS are the admin notification templates per language, selected with ADMIN_LANGUAGE. They are localized
+// independently of what the player sees. Any player of PLAYER_NAMES can be the subject, so the wording must not assume
+// their gender.
+var ADMIN_TEXTS = map[string]map[string]string {
+	"ru": {
+		adminStarted:       "{{name .Player}} начинает искать локации!{{if .Referrer}} Приглашение от {{.Referrer}}.{{end}}{{if .Campaign}} Кампания: {{.Campaign}}.{{end}}",
+		adminCompleted:     "{{name .Player}}: квест пройден!{{if .Count}} Неверных паролей сегодня: {{.Count}}.{{end}}",
+		adminChecking:      "{{name .Player}} проверяет {{.Location}} ({{printf \"%.0f\" .Distance}} м)!",
+		adminWrongPassword: "{{name .Player}} пишет: {{text .Text .Media}}",
+		adminZoneEntered:   "{{name .Player}} входит в зону «{{.Zone}}»",
+		adminZoneLeft:      "{{name .Player}} выходит из зоны «{{.Zone}}»",
+		adminStranger:      "Боту пишет незнакомый чат {{name .Player}} (chat id {{.ChatId}})",
+		adminErrorSpike:    "Ошибки при обработке апдейтов: {{.Count}} из {{.Total}} за {{.Window}}!{{range .Errors}}\n{{.}}{{end}}",
+		adminUpdateFailed:  "Не получилось обработать апдейт {{.UpdateId}}{{if .Error}}: {{.Error}}{{end}}{{if .Text}}\n{{.Text}}{{end}}",
+		adminMuted:         "Уведомления о чате {{.ChatId}} отключены",
+		adminUnmuted:       "Уведомления о чате {{.ChatId}} снова включены",
+		adminUsage:         "Использование: {{.Text}}",
+		adminNoCalls:       "Исходящих запросов еще не было",
+		adminMirror:        "{{name .Player}} в реальном времени:",
+		adminTokenRejected: "Telegram не принимает токен бота (401 Unauthorized), бот не может отвечать. Проверь {{.Text}}.",
+		adminNoTemplate:    "Нет шаблона {{.Text}}",
+		adminRenderError:   "Ошибка: {{.Error}}",
+		adminClosed:        "{{name .Player}} у закрытой локации {{.Location}} ({{printf \"%.0f\" .Distance}} м)",
+		adminNearMiss:      "{{name .Player}} рядом с {{.Location}} ({{printf \"%.0f\" .Distance}} м), но еще не на месте",
+		adminEmergency:     "⚠️ Экстренная отправка в чат {{.ChatId}}: {{.Text}}{{if .Error}}\nНе доставлено: {{.Error}}{{end}}",
+		adminVoice:         "{{name .Player}} присылает голосовое сообщение:",
+		adminAudio:         "{{name .Player}} присылает аудио:",
+		adminNoContact:     "Контакт для приза не настроен",
+		adminBudget:        "Сегодня отправлено {{.Count}} из {{.Total}} сообщений, придержано {{.Suppressed}}",
+		adminBudgetWarning: "⚠️ Отправлено уже {{.Count}} из {{.Total}} сообщений на сегодня",
+		adminBudgetSpent:   "❌ Дневной лимит в {{.Total}} сообщений исчерпан, бот молчит до полуночи UTC. Поднять лимит: /budget <лимит>",
+		adminTransformed:   "{{name .Player}} пишет пароль как «{{.Text}}», засчитан через {{.Transform}}",
+		adminQuizCorrect:   "{{name .Player}} отвечает верно на «{{.Text}}»",
+		adminQuizWrong:     "{{name .Player}} выбирает вариант {{.Count}} в «{{.Text}}», это неверно",
+		adminContactShared: "{{if .Error}}Не удалось отправить контакт в чат {{.ChatId}}: {{.Error}}{{else}}Контакт отправлен в чат {{.ChatId}}{{end}}",
+	},
+	"en": {
+		adminStarted:       "{{name .Player}} started looking for locations!{{if .Referrer}} Invited by {{.Referrer}}.{{end}}{{if .Campaign}} Campaign: {{.Campaign}}.{{end}}",
+		adminCompleted:     "{{name .Player}} made it!{{if .Count}} Wrong passwords today: {{.Count}}.{{end}}",
+		adminChecking:      "{{name .Player}} is checking {{.Location}} ({{printf \"%.0f\" .Distance}} m)!",
+		adminWrongPassword: "{{name .Player}} entered {{text .Text .Media}}!",
+		adminZoneEntered:   "{{name .Player}} entered the zone \"{{.Zone}}\"",
+		adminZoneLeft:      "{{name .Player}} left the zone \"{{.Zone}}\"",
+		adminStranger:      "A stranger {{name .Player}} (chat id {{.ChatId}}) found the bot",
+		adminErrorSpike:    "Updates are failing: {{.Count}} of {{.Total}} in {{.Window}}!{{range .Errors}}\n{{.}}{{end}}",
+		adminUpdateFailed:  "Could not process update {{.UpdateId}}{{if .Error}}: {{.Error}}{{end}}{{if .Text}}\n{{.Text}}{{end}}",
+		adminMuted:         "Notifications about chat {{.ChatId}} are muted",
+		adminUnmuted:       "Notifications about chat {{.ChatId}} are back on",
+		adminUsage:         "Usage: {{.Text}}",
+		adminNoCalls:       "No outbound calls yet",
+		adminMirror:        "{{name .Player}} live:",
+		adminTokenRejected: "Telegram rejects the bot token (401 Unauthorized), the bot can't answer. Check {{.Text}}.",
+		adminNoTemplate:    "No template {{.Text}}",
+		adminRenderError:   "Error: {{.Error}}",
+		adminClosed:        "{{name .Player}} is at the closed location {{.Location}} ({{printf \"%.0f\" .Distance}} m)",
+		adminNearMiss:      "{{name .Player}} is near {{.Location}} ({{printf \"%.0f\" .Distance}} m) but not there yet",
+		adminEmergency:     "⚠️ Emergency send to chat {{.ChatId}}: {{.Text}}{{if .Error}}\nNot delivered: {{.Error}}{{end}}",
+		adminVoice:         "{{name .Player}} sent a voice message:",
+		adminAudio:         "{{name .Player}} sent an audio file:",
+		adminNoContact:     "No prize contact is configured",
+		adminBudget:        "{{.Count}} of {{.Total}} messages sent today, {{.Suppressed}} held back",
+		adminBudgetWarning: "⚠️ {{.Count}} of today's {{.Total}} messages are already sent",
+		adminBudgetSpent:   "❌ The daily limit of {{.Total}} messages is reached, the bot is silent until midnight UTC. Raise it with /budget <limit>",
+		adminTransformed:   "{{name .Player}} entered the password as «{{.Text}}», accepted through {{.Transform}}",
+		adminQuizCorrect:   "{{name .Player}} answered «{{.Text}}» right",
+		adminQuizWrong:     "{{name .Player}} chose option {{.Count}} in «{{.Text}}», which is wrong",
+		adminContactShared: "{{if .Error}}Could not send the contact to chat {{.ChatId}}: {{.Error}}{{else}}Contact sent to chat {{.ChatId}}{{end}}",
+	},
+}
+
+// ADMIN_PLACEHOLDERS stand in for empty values in admin texts, per language: "name" for a missing display name, "text"
+// for an empty message and the media kinds for messages carrying only media.
+var ADMIN_PLACEHOLDERS = map[string]map[string]string {
+	"ru": {
+		"name":     "⟨без имени⟩",
+		"text":     "⟨без текста⟩",
+		"voice":    "⟨голосовое⟩",
+		"audio":    "⟨аудио⟩",
+		"document": "⟨документ⟩",
+		"sticker":  "⟨стикер⟩",
+		"location": "⟨локация⟩",
+	},
+	"en": {
+		"name":     "⟨no name⟩",
+		"text":     "⟨no text⟩",
+		"voice":    "⟨voice message⟩",
+		"audio":    "⟨audio⟩",
+		"document": "⟨document⟩",
+		"sticker":  "⟨sticker⟩",
+		"location": "⟨location⟩",
+	},
+}
+
+// adminPlaceholder returns a placeholder of the admin language, for admin texts built without a template.
+func adminPlaceholder(key string) string {
+	language := adminLanguage
+	if language == "" {
+		language = "ru"
+	}
+	return ADMIN_PLACEHOLDERS[language][key]
+}
+
+// adminFuncs are the template funcs guarding admin texts against empty user data: {{name .Player}} and
+// {{text .Text .Media}}.
+func adminFuncs(placeholders map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"name": func(name string) string {
+			if name == "" {
+				return placeholders["name"]
+			}
+			return name
+		},
+		"text": func(text string, media string) string {
+			if text != "" {
+				return text
+			}
+			if p, ok := placeholders[media]; ok {
+				return p
+			}
+			return placeholders["text"]
+		},
+	}
+}
+
+var adminTemplates map[string]*template.Template
+
+func init() {
+	var err error
+	if adminTemplates, err = loadAdminTemplates(adminLanguage); err != nil {
+		log.Fatalf("invalid admin texts: %s", err.Error())
+	}
+}
+
+// loadAdminTemplates parses the admin catalog of the language, Russian by default, and checks it covers every event.
+func loadAdminTemplates(language string) (map[string]*template.Template, error) {
+	if language == "" {
+		language = "ru"
+	}
+	catalog, ok := ADMIN_TEXTS[language]
+	if !ok {
+		return nil, fmt.Errorf("no admin texts for language %s", language)
+	}
+	placeholders, ok := ADMIN_PLACEHOLDERS[language]
+	if !ok {
+		return nil, fmt.Errorf("no admin placeholders for language %s", language)
+	}
+	templates := make(map[string]*template.Template)
+	for _, event := range adminEvents {
+		text, ok := catalog[event]
+		if !ok {
+			return nil, fmt.Errorf("admin text %s is missing for language %s", event, language)
+		}
+		t, err := template.New(event).Option("missingkey=error").Funcs(adminFuncs(placeholders)).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		templates[event] = t
+	}
+	return templates, nil
+}
+
+// previewData is the sample a /preview renders the admin templates with.
+var previewData = adminData{
+	Player:   "Соня",
+	ChatId:   49208041,
+	Location: "olympia",
+	Distance: 840,
+	Text:     "пароль",
+	Zone:     "дом",
+	Referrer: "@antonhulikau",
+	Campaign: "munich",
+	Count:    3,
+	Total:    12,
+	Window:   10 * time.Minute,
+	Errors:   []string{"telegram error 400: Bad Request"},
+	UpdateId: 42,
+	Error:    "context deadline exceeded",
+}
+
+// previewAdminTexts renders the admin templates of the events with previewData, each labeled with its event, and
+// packs them in as few messages as fit. A template failing to render is reported in its place.
+func previewAdminTexts(events []string) []string {
+	var pages []string
+	page := ""
+	for _, event := range events {
+		var b strings.Builder
+		text := ""
+		if t, ok := adminTemplates[event]; !ok {
+			text = renderAdminText(adminNoTemplate, adminData{Text: event})
+		} else if err := t.Execute(&b, previewData); err != nil {
+			text = renderAdminText(adminRenderError, adminData{Error: err.Error()})
+		} else {
+			text = b.String()
+		}
+		block := TruncateText("[" + event + "]\n" + text)
+		if page != "" && utf8.RuneCountInString(page)+2+utf8.RuneCountInString(block) > MaxTextLength {
+			pages = append(pages, page)
+			page = ""
+		}
+		if page != "" {
+			page += "\n\n"
+		}
+		page += block
+	}
+	if page != "" {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// previewReferrer is the player whose invite button a /preview shows.
+const previewReferrer string = "sonicfelidae"
+
+// previewOpeningHours are the opening hours the closed text is previewed with when no location has any configured.
+const previewOpeningHours string = "Mo-Su 10:00-18:00"
+
+// playerPreview is a player-facing message as /preview sends it: a text with its keyboard, or a quiz poll. Err is why
+// it can't be sent as configured.
+type playerPreview struct {
+	Id       string
+	Text     string
+	Keyboard map[string][][]map[string]string
+	Quiz     *Quiz
+	Err      error
+}
+
+// playerPreviews lists the player-facing messages: the start, stranger and closed texts, the distance tier texts and
+// the texts and quizzes sent by passwords, including those run by a quiz.
+func playerPreviews(now time.Time) []playerPreview {
+	previews := []playerPreview{{Id: "start", Text: START_TEXT}}
+	if STRANGER_START_TEXT != "" {
+		previews = append(previews, playerPreview{Id: "stranger", Text: STRANGER_START_TEXT})
+	}
+	closed := playerPreview{Id: "closed"}
+	hours, err := parseOpeningHours(previewOpeningHours)
+	for _, h := range locationHours {
+		if h != nil {
+			hours, err = h, nil
+			break
+		}
+	}
+	if err != nil {
+		closed.Err = err
+	} else {
+		closed.Text = closedText(hours, now)
+	}
+	previews = append(previews, closed)
+	for i, tier := range DISTANCE_TIERS {
+		previews = append(previews, playerPreview{Id: fmt.Sprintf("tier_%d", i), Text: tier.Text})
+	}
+	passwords := make([]string, 0, len(PASSWORDS))
+	for password := range PASSWORDS {
+		passwords = append(passwords, password)
+	}
+	sort.Strings(passwords)
+	for _, password := range passwords {
+		previews = appendActionPreviews(previews, "password_"+password, PASSWORDS[password])
+	}
+	for i := range previews {
+		if previews[i].Err == nil {
+			previews[i].Err = checkPlayerPreview(previews[i])
+		}
+	}
+	return previews
+}
+
+// appendActionPreviews adds the send_text and send_quiz actions, id is the owner followed by the action index.
+func appendActionPreviews(previews []playerPreview, owner string, actions []PasswordAction) []playerPreview {
+	for i, a := range actions {
+		id := fmt.Sprintf("%s_%d", owner, i)
+		switch a.Type {
+		case actionSendText:
+			p := playerPreview{Id: id, Text: a.Text}
+			if a.Share {
+				if p.Keyboard = shareKeyboard(previewReferrer); p.Keyboard == nil {
+					p.Err = fmt.Errorf("no invite button, %s is not set", telegramBotUsernameEnv)
+				}
+			}
+			previews = append(previews, p)
+		case actionSendQuiz:
+			previews = append(previews, playerPreview{Id: id, Quiz: a.Quiz})
+			if a.Quiz != nil {
+				previews = appendActionPreviews(previews, id, a.Quiz.Actions)
+			}
+		}
+	}
+	return previews
+}
+
+// checkPlayerPreview tells why Telegram would refuse or cut the message.
+func checkPlayerPreview(p playerPreview) error {
+	if p.Quiz != nil {
+		return validateQuiz(p.Quiz)
+	}
+	if p.Text == "" {
+		return errors.New("empty text")
+	}
+	if n := utf8.RuneCountInString(p.Text); n > MaxTextLength {
+		return fmt.Errorf("text is %d characters long, it would be cut to %d", n, MaxTextLength)
+	}
+	if p.Keyboard != nil {
+		return checkInlineKeyboard(p.Keyboard, false)
+	}
+	return nil
+}
+
+// findPlayerPreview returns the player-facing message with the id.
+func findPlayerPreview(id string, now time.Time) (playerPreview, bool) {
+	for _, p := range playerPreviews(now) {
+		if p.Id == id {
+			return p, true
+		}
+	}
+	return playerPreview{}, false
+}
+
+// renderAdminText renders the admin notification of an event. Rendering errors are logged and the bare event name is
+// returned, so the admin still learns something happened.
+func renderAdminText(event string, data adminData) string {
+	var b strings.Builder
+	if err := adminTemplates[event].Execute(&b, data); err != nil {
+		log.Printf("could not render admin text %s: %s", event, err.Error())
+		return event
+	}
+	return b.String()
+}
+
+// Types of PasswordAction
+const (
+	actionSendText      string = "send_text"
+	actionSendLocation  string = "send_location"
+	actionSendDocument  string = "send_document"
+	actionSendQuiz      string = "send_quiz"
+	actionNotifyAdmin   string = "notify_admin"
+	actionCompleteQuest string = "complete_quest"
+)
+
+// PasswordAction is one step executed when the player enters a password. Text is used by send_text and
+// notify_admin, Location by send_location. Share attaches the invite button to a send_text. send_document sends
+// Document, a file_id, a URL or the path of a file deployed with the function, with Text as its caption. send_quiz
+// asks Quiz and only runs its actions once answered right.
+type PasswordAction struct {
+	Type     string
+	Text     string
+	Location Location
+	Share    bool
+	Document string
+	Quiz     *Quiz
+}
+
+// PASSWORDS maps lower case passwords to the actions they trigger, in order. A code can unlock an intermediate reward
+// or finish the game with complete_quest.
+var PASSWORDS = map[string][]PasswordAction {
+	"afsio": {
+		PasswordAction {Type: actionSendText, Share: true, Text: "Молодец! Все верно!\nВ качестве приза могли прийти, но не пришли:\n1. Поездка в Австрию на викенд. Но она почему-то вводит локдаун.\n2. Поход на Щелкунчика. Но кто-то прощелкал все полимеры =(.\n3. Карты с покемонами на испанском. Но они у тебя уже есть.\n\n\n\nНо зато пришел: бессрочный recharge day on demand. Предложение отвезти тебя, куда ты захочешь, на 1 день. Используй его, когда тебе вздумается."},
+		PasswordAction {Type: actionCompleteQuest},
+	},
+}
+
+func init() {
+	if err := validatePasswords(PASSWORDS); err != nil {
+		log.Fatalf("invalid passwords: %s", err.Error())
+	}
+}
+
+// Transforms accepting a password typed in another script or keyboard layout, enabled per password in
+// PASSWORD_TRANSFORMS
+const (
+	transformTranslit string = "translit"
+	transformLayout   string = "layout"
+)
+
+// PASSWORD_TRANSFORMS are the transforms each password also accepts a guess through, after lower-casing it.
+var PASSWORD_TRANSFORMS = map[string][]string {
+	"afsio": {transformTranslit, transformLayout},
+}
+
+// passwordTransform tells whether a lower case guess matches a password once transformed.
+type passwordTransform struct {
+	Name  string
+	Match func(guess string, password string) bool
+}
+
+// passwordTransforms are tried in this order, so a guess matching several ways always reports the same transform.
+var passwordTransforms = [...]passwordTransform{
+	{Name: transformTranslit, Match: func(guess string, password string) bool {
+		return transliterate(guess) == transliterate(password)
+	}},
+	{Name: transformLayout, Match: func(guess string, password string) bool {
+		return swapLayout(guess) == password
+	}},
+}
+
+func init() {
+	known := make(map[string]bool)
+	for _, t := range passwordTransforms {
+		known[t.Name] = true
+	}
+	for password, transforms := range PASSWORD_TRANSFORMS {
+		if _, ok := PASSWORDS[password]; !ok {
+			log.Fatalf("transforms configured for unknown password %s", password)
+		}
+		for _, name := range transforms {
+			if !known[name] {
+				log.Fatalf("unknown transform %q for password %s", name, password)
+			}
+		}
+	}
+}
+
+// matchPassword finds the password the text is, exactly or through one of the transforms enabled for it, and returns
+// the name of the transform, empty for an exact match.
+func matchPassword(text string) ([]PasswordAction, string, bool) {
+	guess := to_lower_letters(text)
+	if actions, ok := PASSWORDS[guess]; ok {
+		return actions, "", true
+	}
+	passwords := make([]string, 0, len(PASSWORD_TRANSFORMS))
+	for password := range PASSWORD_TRANSFORMS {
+		passwords = append(passwords, password)
+	}
+	sort.Strings(passwords)
+	for _, t := range passwordTransforms {
+		for _, password := range passwords {
+			if hasTransform(PASSWORD_TRANSFORMS[password], t.Name) && t.Match(guess, password) {
+				return PASSWORDS[password], t.Name, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+func hasTransform(transforms []string, name string) bool {
+	for _, t := range transforms {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CYRILLIC_TO_LATIN transliterates lower case Russian letters, close to how people spell Russian with a Latin keyboard.
+var CYRILLIC_TO_LATIN = map[rune]string {
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z", 'и': "i", 'й': "y",
+	'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f",
+	'х': "h", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "sch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+// transliterate spells the Cyrillic letters of s in Latin, so a guess and a password compare in the same script.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if latin, ok := CYRILLIC_TO_LATIN[r]; ok {
+			b.WriteString(latin)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// The keys of the Russian ЙЦУКЕН layout and the keys of the English QWERTY layout in the same positions.
+const layoutRussian string = "ёйцукенгшщзхъфывапролджэячсмитьбю"
+const layoutEnglish string = "`qwertyuiop[]asdfghjkl;'zxcvbnm,."
+
+var layoutSwap = func() map[rune]rune {
+	ru, en := []rune(layoutRussian), []rune(layoutEnglish)
+	swap := make(map[rune]rune, 2*len(ru))
+	for i := range ru {
+		swap[ru[i]] = en[i]
+		swap[en[i]] = ru[i]
+	}
+	return swap
+}()
+
+// swapLayout retypes s on the other keyboard layout, e.g. "фаышщ" typed for "afsio" with the Russian layout on.
+func swapLayout(s string) string {
+	return strings.Map(func(r rune) rune {
+		if swapped, ok := layoutSwap[r]; ok {
+			return swapped
+		}
+		return r
+	}, s)
+}
+
+// validatePasswords rejects unknown action types and actions missing what they need, so mistakes fail at start-up
+// rather than when the player enters the code.
+func validatePasswords(passwords map[string][]PasswordAction) error {
+	for password, actions := range passwords {
+		if password != to_lower_letters(password) {
+			return fmt.Errorf("password %s must be lower case", password)
+		}
+		if len(actions) == 0 {
+			return fmt.Errorf("password %s has no actions", password)
+		}
+		if err := validateActions("password "+password, actions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateActions checks the actions of owner, e.g. "password afsio".
+func validateActions(owner string, actions []PasswordAction) error {
+	for i, a := range actions {
+		switch a.Type {
+		case actionSendText, actionNotifyAdmin:
+			if a.Text == "" {
+				return fmt.Errorf("action %d (%s) of %s has no text", i, a.Type, owner)
+			}
+		case actionSendLocation:
+			if a.Location.Latitude == 0 && a.Location.Longitude == 0 {
+				return fmt.Errorf("action %d (%s) of %s has no location", i, a.Type, owner)
+			}
+		case actionSendDocument:
+			if a.Document == "" {
+				return fmt.Errorf("action %d (%s) of %s has no document", i, a.Type, owner)
+			}
+			if err := checkCaption(a.Text); err != nil {
+				return fmt.Errorf("action %d (%s) of %s: %s", i, a.Type, owner, err.Error())
+			}
+			if isLocalFile(a.Document) {
+				if _, err := os.Stat(a.Document); err != nil {
+					return fmt.Errorf("action %d (%s) of %s: %s", i, a.Type, owner, err.Error())
+				}
+			}
+		case actionSendQuiz:
+			if err := validateQuiz(a.Quiz); err != nil {
+				return fmt.Errorf("action %d (%s) of %s: %s", i, a.Type, owner, err.Error())
+			}
+		case actionCompleteQuest:
+		default:
+			return fmt.Errorf("action %d of %s has unknown type %q", i, owner, a.Type)
+		}
+	}
+	return nil
+}
+
+// Quiz is a multiple-choice question sent as a Telegram quiz poll. Answering Options[Correct] runs Actions, any other
+// answer asks the question again.
+type Quiz struct {
+	Question string
+	Options  []string
+	Correct  int
+	Actions  []PasswordAction
+}
+
+// Telegram limits on quiz polls
+const maxPollQuestionLength int = 300
+const maxPollOptionLength int = 100
+const minPollOptions int = 2
+const maxPollOptions int = 10
+
+func validateQuiz(q *Quiz) error {
+	if q == nil || q.Question == "" {
+		return errors.New("no question")
+	}
+	if utf8.RuneCountInString(q.Question) > maxPollQuestionLength {
+		return fmt.Errorf("question is longer than %d characters", maxPollQuestionLength)
+	}
+	if len(q.Options) < minPollOptions || len(q.Options) > maxPollOptions {
+		return fmt.Errorf("%d options, %d to %d are allowed", len(q.Options), minPollOptions, maxPollOptions)
+	}
+	for i, option := range q.Options {
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLength {
+			return fmt.Errorf("option %d must have 1 to %d characters", i, maxPollOptionLength)
+		}
+	}
+	if q.Correct < 0 || q.Correct >= len(q.Options) {
+		return fmt.Errorf("correct option %d is not one of the options", q.Correct)
+	}
+	return validateActions("quiz "+strconv.Quote(q.Question), q.Actions)
+}
+
+// quizPolls maps the quiz polls sent to players to their chat and quiz, per warm instance. An answer to a poll sent
+// before a cold start is not recognized, the player has to enter the password again.
+type quizPolls struct {
+	mu    sync.Mutex
+	polls map[string]quizPoll
+}
+
+type quizPoll struct {
+	ChatId int
+	Quiz   *Quiz
+}
+
+var polls = &quizPolls{polls: make(map[string]quizPoll)}
+
+func (q *quizPolls) add(pollId string, poll quizPoll) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.polls[pollId] = poll
+}
+
+// take returns the poll and forgets it, as a quiz can only be answered once.
+func (q *quizPolls) take(pollId string) (quizPoll, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	poll, ok := q.polls[pollId]
+	delete(q.polls, pollId)
+	return poll, ok
+}
+
+// handlePollAnswer reacts to the answer of a player to a quiz: the right option runs the actions of the quiz, a wrong
+// one sends it again.
+func handlePollAnswer(ctx context.Context, res *Result, answer PollAnswer) {
+	if len(answer.OptionIds) == 0 {
+		// a retracted vote, quizzes don't allow it but regular polls do
+		res.Kind = KindUnrecognized
+		trace(ctx, "poll", "retracted")
+		return
+	}
+	poll, ok := polls.take(answer.PollId)
+	if !ok {
+		res.Kind = KindUnrecognized
+		trace(ctx, "poll", "unknown")
+		return
+	}
+	res.Kind = KindPollAnswer
+	res.Muted = muted.has(poll.ChatId)
+	chosen := answer.OptionIds[0]
+	correct := chosen == poll.Quiz.Correct
+	trace(ctx, "quiz", strconv.FormatBool(correct))
+	data := adminData{Player: displayName(answer.User.Username), Text: poll.Quiz.Question, Count: chosen + 1}
+	if correct {
+		res.notifyAdmin(ctx, renderAdminText(adminQuizCorrect, data))
+		runPasswordActions(ctx, res, poll.ChatId, answer.User.Username, poll.Quiz.Actions)
+	} else {
+		res.notifyAdmin(ctx, renderAdminText(adminQuizWrong, data))
+		res.sendText(ctx, poll.ChatId, "Неправильно, попробуй еще раз!")
+		res.sendQuiz(ctx, poll.ChatId, poll.Quiz)
+	}
+}
+
+// runPasswordActions executes the actions of a password for the chat.
+func runPasswordActions(ctx context.Context, res *Result, chatId int, username string, actions []PasswordAction) {
+	player := displayName(username)
+	for _, a := range actions {
+		switch a.Type {
+		case actionSendText:
+			if a.Share {
+				res.sendTextWithKeyboard(ctx, chatId, a.Text, shareKeyboard(username))
+			} else {
+				res.sendText(ctx, chatId, a.Text)
+			}
+		case actionSendLocation:
+			res.sendLocation(ctx, chatId, a.Location)
+		case actionSendDocument:
+			res.sendDocument(ctx, chatId, a.Document, a.Text)
+		case actionSendQuiz:
+			res.sendQuiz(ctx, chatId, a.Quiz)
+		case actionNotifyAdmin:
+			res.notifyAdmin(ctx, a.Text)
+		case actionCompleteQuest:
+			data := adminData{Player: player}
+			if wrongPasswordNotify == notifyCount {
+				data.Count = wrongPasswords.today(time.Now())
+			}
+			text := renderAdminText(adminCompleted, data)
+			res.notifyAdmin(ctx, text)
+			if !res.Muted {
+				raiseAlert(res.pendingAlerts(), adminCompleted, text)
+			}
+		}
+	}
+}
+
+// MapZoom is the static map zoom used for clues whose radius is at most MaxRadius meters.
+type MapZoom struct {
+	MaxRadius float64
+	Zoom      int
+}
+
+// MAP_ZOOMS are ordered by increasing radius, bigger radii get a wider map. Radii above the last are shown at minMapZoom.
+var MAP_ZOOMS = [...]MapZoom {
+	MapZoom {MaxRadius: 250, Zoom: 17},
+	MapZoom {MaxRadius: 1000, Zoom: 15},
+	MapZoom {MaxRadius: 3000, Zoom: 14},
+}
+
+const minMapZoom int = 12
+
+func mapZoom(radius float64) int {
+	for _, z := range MAP_ZOOMS {
+		if radius <= z.MaxRadius {
+			return z.Zoom
+		}
+	}
+	return minMapZoom
+}
+
+// staticMapURL fills the configured static map template with the clue and a zoom fitting its radius. It returns false
+// when no template is configured.
+func staticMapURL(l Location, radius float64) (string, bool) {
+	if staticMapUrl == "" {
+		return "", false
+	}
+	replacer := strings.NewReplacer(
+		"{lat}", url.QueryEscape(strconv.FormatFloat(l.Latitude, 'f', 6, 64)),
+		"{lon}", url.QueryEscape(strconv.FormatFloat(l.Longitude, 'f', 6, 64)),
+		"{zoom}", strconv.Itoa(mapZoom(radius)),
+	)
+	return replacer.Replace(staticMapUrl), true
+}
+
+// START_TEXT is the reply to /start from players.
+var START_TEXT = "Присылай мне свою локацию. Если ты будешь относительно близко к расположению подсказки, я дам тебе точные координаты!\nУ меня есть так же команда /unlock =)"
+
+// STRANGER_START_TEXT is the reply to /start from users not in ALLOWED_USERS. Leave it empty to stay silent.
+var STRANGER_START_TEXT = "Привет! Этот бот сделан для одного конкретного квеста и, к сожалению, не для тебя. Хорошего дня!"
+
+// strangerRegistry remembers which unauthorized chats were already answered today and reported to the admin. It only
+// lives as long as the warm instance does.
+type strangerRegistry struct {
+	mu       sync.Mutex
+	answered map[int]string
+	reported map[int]bool
+}
+
+var strangers = &strangerRegistry{answered: make(map[int]string), reported: make(map[int]bool)}
+
+// shouldAnswer returns true at most once per chat per UTC day.
+func (r *strangerRegistry) shouldAnswer(chatId int, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	day := now.UTC().Format("2006-01-02")
+	if r.answered[chatId] == day {
+		return false
+	}
+	r.answered[chatId] = day
+	return true
+}
+
+// firstSeen returns true the first time a chat is seen.
+func (r *strangerRegistry) firstSeen(chatId int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reported[chatId] {
+		return false
+	}
+	r.reported[chatId] = true
+	return true
+}
+
+// known returns true if the chat was seen before, without marking it.
+func (r *strangerRegistry) known(chatId int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reported[chatId]
+}
+
+// handleStranger answers /start from an unauthorized chat politely and lets the admin know about new strangers. Any
+// other message from them is ignored.
+func handleStranger(ctx context.Context, res *Result, m Message) {
+	if m.Chat.Id == 0 {
+		return
+	}
+	if strangers.firstSeen(m.Chat.Id) {
+		trace(ctx, "stranger", "new")
+		res.notifyAdmin(ctx, renderAdminText(adminStranger, adminData{Player: displayName(m.Chat.Username), ChatId: m.Chat.Id}))
+	}
+	if isStart, _ := parseStartCommand(m.Text); !isStart || STRANGER_START_TEXT == "" {
+		trace(ctx, "reply", "silent")
+		return
+	}
+	if !strangers.shouldAnswer(m.Chat.Id, time.Now()) {
+		trace(ctx, "reply", "limited")
+		return
+	}
+	trace(ctx, "reply", "not_for_you")
+	res.sendText(ctx, m.Chat.Id, STRANGER_START_TEXT)
+}
+
+// mutedChats are the chats, typically co-organizers testing the quest, whose activity doesn't notify the admin. Set
+// with /mute and /unmute, it lives as long as the warm instance does.
+type mutedChats struct {
+	mu    sync.Mutex
+	chats map[int]bool
+}
+
+var muted = &mutedChats{chats: make(map[int]bool)}
+
+func (c *mutedChats) set(chatId int, mute bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if mute {
+		c.chats[chatId] = true
+	} else {
+		delete(c.chats, chatId)
+	}
+}
+
+func (c *mutedChats) has(chatId int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chats[chatId]
+}
+
+// handleAdminCommand runs the admin commands, accepted from the admin chat only. It returns false for any other
+// message, which then goes through the usual flow.
+func handleAdminCommand(ctx context.Context, res *Result, m Message) bool {
+	fields := strings.Fields(m.Text)
+	if m.Chat.Id != ANTON_CHAT_ID || len(fields) == 0 {
+		return false
+	}
+	fields[0] = commandName(fields[0])
+	switch fields[0] {
+	case "/mute", "/unmute":
+		trace(ctx, "branch", "admin"+fields[0])
+		chatId := 0
+		if len(fields) == 2 {
+			chatId, _ = strconv.Atoi(fields[1])
+		}
+		if chatId == 0 {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminUsage, adminData{Text: fields[0] + " <chat_id>"})}
+			break
+		}
+		muted.set(chatId, fields[0] == "/mute")
+		event := adminMuted
+		if fields[0] == "/unmute" {
+			event = adminUnmuted
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(event, adminData{ChatId: chatId})}
+	case "/whoami":
+		if len(fields) != 2 {
+			// the admin asking about themselves
+			return false
+		}
+		trace(ctx, "branch", "admin/whoami")
+		chatId, err := strconv.Atoi(fields[1])
+		if err != nil {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminUsage, adminData{Text: "/whoami <chat_id>"})}
+			break
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: whoamiText(chatId, time.Now(), true)}
+	case "/preview":
+		trace(ctx, "branch", "admin/preview")
+		if len(fields) != 2 {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminUsage, adminData{Text: "/preview <template|all>"})}
+			break
+		}
+		events := fields[1:]
+		var players []playerPreview
+		if fields[1] == "all" {
+			events = adminEvents[:]
+			players = playerPreviews(time.Now())
+		} else if p, ok := findPlayerPreview(fields[1], time.Now()); ok {
+			events = nil
+			players = []playerPreview{p}
+		}
+		pages := previewAdminTexts(events)
+		if len(pages) == 1 && len(players) == 0 {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: pages[0]}
+			break
+		}
+		for _, page := range pages {
+			res.sendText(ctx, m.Chat.Id, page)
+		}
+		for _, p := range players {
+			res.sendPlayerPreview(ctx, m.Chat.Id, p)
+		}
+	case "/sharecontact":
+		trace(ctx, "branch", "admin/sharecontact")
+		chatId := 0
+		if len(fields) == 2 {
+			chatId, _ = strconv.Atoi(fields[1])
+		}
+		if chatId == 0 {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminUsage, adminData{Text: "/sharecontact <chat_id>"})}
+			break
+		}
+		if PRIZE_CONTACT.Phone == "" {
+			res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminNoContact, adminData{})}
+			break
+		}
+		data := adminData{ChatId: chatId}
+		if err := res.sendContact(ctx, chatId, PRIZE_CONTACT); err != nil {
+			data.Error = err.Error()
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminContactShared, data)}
+	case "/budget":
+		trace(ctx, "branch", "admin/budget")
+		if len(fields) == 2 {
+			limit, err := strconv.Atoi(fields[1])
+			if err != nil || limit <= 0 {
+				res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminUsage, adminData{Text: "/budget [limit]"})}
+				break
+			}
+			outbound.raise(time.Now(), limit)
+		}
+		sent, suppressed, limit := outbound.status(time.Now())
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: renderAdminText(adminBudget, adminData{Count: sent, Total: limit, Suppressed: suppressed})}
+	case "/diag":
+		trace(ctx, "branch", "admin/diag")
+		report := runDiagnostics(ctx, diagnostics(defaultClient()), envDuration(diagBudgetEnv, 5*time.Second), diagCheckTimeout)
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: TruncateText(strings.Join(report, "\n"))}
+	case "/lastcalls":
+		trace(ctx, "branch", "admin/lastcalls")
+		n := 5
+		if len(fields) == 2 {
+			if parsed, err := strconv.Atoi(fields[1]); err == nil && parsed > 0 {
+				n = parsed
+			}
+		}
+		text := renderAdminText(adminNoCalls, adminData{})
+		if calls := lastCalls.last(n); len(calls) > 0 {
+			text = renderCalls(calls)
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: m.Chat.Id, Text: text}
+	default:
+		return false
+	}
+	res.Kind = KindCommand
+	return true
+}
+
+// liveMirror remembers the live location mirrored to the admin chat for each player, per warm instance. A cold start
+// simply sends a new one.
+type liveMirror struct {
+	mu      sync.Mutex
+	mirrors map[int]mirroredLocation
+}
+
+type mirroredLocation struct {
+	messageId int
+	expires   time.Time
+	updated   time.Time
+}
+
+var mirrors = &liveMirror{mirrors: make(map[int]mirroredLocation)}
+
+func init() {
+	if adminLivePeriod < time.Minute || adminLivePeriod > 24*time.Hour {
+		log.Fatalf("%s must be between 1m and 24h, got %s", adminLivePeriodEnv, adminLivePeriod)
+	}
+}
+
+// next returns the live location message to edit for a new ping of the chat, 0 to send a new one, or skip when the
+// last update is too recent.
+func (m *liveMirror) next(chatId int, now time.Time) (messageId int, skip bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mirror, ok := m.mirrors[chatId]
+	if !ok {
+		return 0, false
+	}
+	if now.Sub(mirror.updated) < liveLocationEditInterval {
+		return 0, true
+	}
+	if !now.Before(mirror.expires) {
+		return 0, false
+	}
+	return mirror.messageId, false
+}
+
+func (m *liveMirror) sent(chatId int, messageId int, now time.Time, period time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mirrors[chatId] = mirroredLocation{messageId: messageId, expires: now.Add(period), updated: now}
+}
+
+func (m *liveMirror) edited(chatId int, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mirror, ok := m.mirrors[chatId]; ok {
+		mirror.updated = now
+		m.mirrors[chatId] = mirror
+	}
+}
+
+func (m *liveMirror) forget(chatId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mirrors, chatId)
+}
+
+// chatActivity is what the bot remembers about each player for /whoami. It lives as long as the warm instance does.
+type chatActivity struct {
+	mu    sync.Mutex
+	chats map[int]chatInfo
+}
+
+type chatInfo struct {
+	Username string
+	LastPing time.Time
+	Accuracy float64
+}
+
+var activity = &chatActivity{chats: make(map[int]chatInfo)}
+
+func (a *chatActivity) seen(m Message, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info := a.chats[m.Chat.Id]
+	info.Username = m.Chat.Username
+	if m.Location.Latitude != 0 || m.Location.Longitude != 0 {
+		info.LastPing = now
+		info.Accuracy = m.Location.HorizontalAccuracy
+	}
+	a.chats[m.Chat.Id] = info
+}
+
+func (a *chatActivity) get(chatId int) (chatInfo, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, ok := a.chats[chatId]
+	return info, ok
+}
+
+// whoamiText tells what the bot knows about a chat, so a player can check their location gets through. The admin
+// asking about another chat gets it told about the player instead of to them.
+func whoamiText(chatId int, now time.Time, admin bool) string {
+	info, ok := activity.get(chatId)
+	if !ok {
+		return fmt.Sprintf("Про чат %d я ничего не знаю", chatId)
+	}
+	name := displayName(info.Username)
+	if name == "" {
+		name = adminPlaceholder("name")
+	}
+	text := fmt.Sprintf("Ты %s, chat id %d.\n", name, chatId)
+	if admin {
+		text = fmt.Sprintf("Это %s, chat id %d.\n", name, chatId)
+	}
+	if info.LastPing.IsZero() && admin {
+		text += "Локаций из этого чата я еще не получал."
+	} else if info.LastPing.IsZero() {
+		text += "Локацию я от тебя еще не получал."
+	} else if ago := now.Sub(info.LastPing); ago < time.Minute {
+		text += "Последнюю локацию я получил только что"
+	} else {
+		text += fmt.Sprintf("Последнюю локацию я получил %d мин назад", int(ago.Minutes()))
+	}
+	if !info.LastPing.IsZero() && info.Accuracy > 0 {
+		text += fmt.Sprintf(", точность %.0f м.", info.Accuracy)
+	} else if !info.LastPing.IsZero() {
+		text += "."
+	}
+	if muted.has(chatId) && admin {
+		text += "\nУведомления об этом чате отключены."
+	} else if muted.has(chatId) {
+		text += "\nУведомления админу о тебе отключены."
+	}
+	return text
+}
+
+// Commands offered as suggestions for a mistyped command, to players and additionally to the admin.
+var PLAYER_COMMANDS = [...]string{"/start", "/unlock", "/whoami"}
+var ADMIN_COMMANDS = [...]string{"/mute", "/unmute", "/lastcalls", "/preview", "/whoami", "/diag", "/sharecontact", "/budget"}
+
+const maxCommandSuggestions int = 3
+
+// commandEntity returns the command a message starts with, without arguments or the @botname suffix, if Telegram
+// marked one.
+func commandEntity(m Message) (string, bool) {
+	fields := strings.Fields(m.Text)
+	if len(fields) == 0 {
+		return "", false
+	}
+	for _, e := range m.Entities {
+		if e.Type == "bot_command" && e.Offset == 0 {
+			return commandName(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// commandName strips the @botname suffix Telegram adds to commands picked from the menu in a group, so /start@bot is
+// handled as /start. Anything not starting with a slash is returned as is.
+func commandName(word string) string {
+	if at := strings.Index(word, "@"); at >= 0 && strings.HasPrefix(word, "/") {
+		return word[:at]
+	}
+	return word
+}
+
+// editDistance is the number of insertions, deletions, substitutions and transpositions of adjacent runes turning a
+// into b (the optimal string alignment distance), so /strat is one typo away from /start.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+// suggestCommands returns the closest known commands to a mistyped one, at most maxCommandSuggestions. Commands of
+// up to two letters get no suggestion, anything would be close to them; longer ones allow one typo per three letters.
+func suggestCommands(command string, admin bool) []string {
+	name := strings.TrimPrefix(command, "/")
+	allowed := utf8.RuneCountInString(name) / 3
+	if allowed == 0 {
+		return nil
+	}
+	known := PLAYER_COMMANDS[:]
+	if admin {
+		known = append(known[:len(known):len(known)], ADMIN_COMMANDS[:]...)
+	}
+	distances := make(map[string]int)
+	var suggestions []string
+	for _, k := range known {
+		if _, ok := distances[k]; ok {
+			continue
+		}
+		if d := editDistance(strings.ToLower(name), strings.TrimPrefix(k, "/")); d <= allowed {
+			distances[k] = d
+			suggestions = append(suggestions, k)
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return distances[suggestions[i]] < distances[suggestions[j]]
+	})
+	if len(suggestions) > maxCommandSuggestions {
+		suggestions = suggestions[:maxCommandSuggestions]
+	}
+	return suggestions
+}
+
+// Outcomes of a /diag check
+type diagStatus string
+
+const (
+	diagOk   diagStatus = "✅"
+	diagWarn diagStatus = "⚠️"
+	diagFail diagStatus = "❌"
+)
+
+// diagCheck is one line of the /diag report.
+type diagCheck struct {
+	Name string
+	Run  func(ctx context.Context) (diagStatus, string)
+}
+
+// diagnostics are the checks of /diag: the bot token, the webhook registration and what this instance has seen.
+func diagnostics(client *Client) []diagCheck {
+	return []diagCheck{
+		{"token", func(ctx context.Context) (diagStatus, string) {
+			username, err := client.GetMe(ctx)
+			if err != nil {
+				return diagFail, err.Error()
+			}
+			return diagOk, "@" + username
+		}},
+		{"webhook", func(ctx context.Context) (diagStatus, string) {
+			info, err := client.GetWebhookInfo(ctx)
+			if err != nil {
+				return diagFail, err.Error()
+			}
+			if info.Url == "" {
+				return diagFail, "not set"
+			}
+			detail := fmt.Sprintf("%d pending", info.PendingUpdateCount)
+			if info.LastErrorMessage != "" {
+				return diagWarn, detail + fmt.Sprintf(", last error %s ago: %s", time.Since(time.Unix(info.LastErrorDate, 0)).Round(time.Second), info.LastErrorMessage)
+			}
+			return diagOk, detail
+		}},
+		{"errors", func(ctx context.Context) (diagStatus, string) {
+			recent := errorRate.recentErrors(3)
+			if len(recent) == 0 {
+				return diagOk, "none in the window"
+			}
+			return diagWarn, strings.Join(recent, "; ")
+		}},
+		{"instance", func(ctx context.Context) (diagStatus, string) {
+			return diagOk, fmt.Sprintf("%d strangers skipped, %d calls captured", atomic.LoadInt64(&fastPathUpdates), lastCalls.count())
+		}},
+	}
+}
+
+// runDiagnostics runs the checks concurrently, each within timeout, and reports within budget whatever has finished.
+// A check still running by then is reported as timed out.
+func runDiagnostics(ctx context.Context, checks []diagCheck, budget time.Duration, timeout time.Duration) []string {
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	lines := make([]string, len(checks))
+	done := make(chan int, len(checks))
+	for i, check := range checks {
+		go func(i int, check diagCheck) {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			status, detail := check.Run(checkCtx)
+			lines[i] = fmt.Sprintf("%s %s: %s", status, check.Name, detail)
+			done <- i
+		}(i, check)
+	}
+	finished := make([]bool, len(checks))
+	for pending := len(checks); pending > 0; pending-- {
+		select {
+		case i := <-done:
+			finished[i] = true
+		case <-ctx.Done():
+			pending = 0
+		}
+	}
+	report := make([]string, len(checks))
+	for i, check := range checks {
+		if finished[i] {
+			report[i] = lines[i]
+		} else {
+			report[i] = fmt.Sprintf("%s %s: timed out", diagFail, check.Name)
+		}
+	}
+	return report
+}
+
+func isAllowed(e string) bool {
+    for _, a := range ALLOWED_USERS {
+        if a == e {
+            return true
+        }
+    }
+    return e != "" && invites.has(e)
+}
+
+func to_lower_letters(s string) string {
+	ret := strings.ToLower(s);
+	return ret;
+}
+
+func envFloat(name string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// parseStartCommand tells whether text is a /start command and returns its deep-link payload, if a valid one was
+// given.
+func parseStartCommand(text string) (bool, string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || commandName(fields[0]) != "/start" {
+		return false, ""
+	}
+	if len(fields) == 2 && startPayloadPattern.MatchString(fields[1]) {
+		return true, fields[1]
+	}
+	return true, ""
+}
+
+// matchStartPayload resolves a deep-link payload either to a campaign or to the player that invited the user.
+// Payloads matching neither are ignored and the plain /start flow is used.
+func matchStartPayload(payload string) (campaign string, referrer string) {
+	if strings.HasPrefix(payload, referralPrefix) {
+		if r := strings.TrimPrefix(payload, referralPrefix); isAllowed(r) {
+			return "", r
+		}
+		return "", ""
+	}
+	return CAMPAIGNS[payload], ""
+}
+
+// shareKeyboard builds the "invite a friend" button which opens the share dialog with a link carrying the referrer's
+// code. It returns nil when the bot username is not configured since the link can't be built then.
+func shareKeyboard(referrer string) map[string][][]map[string]string {
+	if telegramBotUsername == "" || referrer == "" {
+		return nil
+	}
+	link := fmt.Sprintf("https://t.me/%s?start=%s%s", telegramBotUsername, referralPrefix, referrer)
+	share := "https://t.me/share/url?" + url.Values{
+		"url": {link},
+		"text": {"Попробуй найти все подсказки!"},
+	}.Encode()
+
+	keyboard := make(map[string][][]map[string]string)
+	var fo = []map[string]string{}
+	fo = append(fo, map[string]string {"text": "Пригласить друга", "url": share})
+	keyboard["inline_keyboard"] = [][]map[string]string{fo}
+	return keyboard
+}
+
+// logTelegramResponse logs the outcome of a Telegram call. The full body is only logged in debug mode, and even then
+// truncated, since keyboard-bearing answers are large and logging them on every call is costly.
+func logTelegramResponse(body []byte) {
+	var response APIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Printf("could not decode telegram response: %s", err.Error())
+	} else if response.Ok {
+		var result struct {
+			MessageId int `json:"message_id"`
+		}
+		json.Unmarshal(response.Result, &result)
+		log.Printf("Telegram response: ok, message_id %d", result.MessageId)
+	} else {
+		log.Printf("Telegram response: error %d, %s", response.ErrorCode, response.Description)
+	}
+	if logDebug {
+		log.Printf("Body of Telegram Response: %s", truncateForLog(string(body), logBodyMaxLength))
+	}
+}
+
+// outboundCall is a Telegram API call as captured for /lastcalls, with the bot token redacted.
+type outboundCall struct {
+	At       time.Time
+	Method   string
+	URL      string
+	Request  string
+	Status   int
+	Response string
+	Duration time.Duration
+	Err      string
+}
+
+// callCapture keeps the last outbound calls of the warm instance in a ring buffer, so a rejected payload can be
+// inspected without redeploying. A zero size disables it.
+type callCapture struct {
+	mu    sync.Mutex
+	calls []outboundCall
+	next  int
+	full  bool
+}
+
+func newCallCapture(size int) *callCapture {
+	if size < 0 {
+		size = 0
+	}
+	return &callCapture{calls: make([]outboundCall, size)}
+}
+
+func (c *callCapture) add(call outboundCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.calls) == 0 {
+		return
+	}
+	c.calls[c.next] = call
+	c.next = (c.next + 1) % len(c.calls)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+func (c *callCapture) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.full {
+		return len(c.calls)
+	}
+	return c.next
+}
+
+// last returns up to n captured calls, the newest first.
+func (c *callCapture) last(n int) []outboundCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := c.next
+	if c.full {
+		count = len(c.calls)
+	}
+	if n > count {
+		n = count
+	}
+	calls := make([]outboundCall, 0, n)
+	for i := 1; i <= n; i++ {
+		calls = append(calls, c.calls[(c.next-i+len(c.calls))%len(c.calls)])
+	}
+	return calls
+}
+
+// redactToken removes the bot token from captured URLs and bodies.
+func redactToken(s string, secret string) string {
+	if secret != "" {
+		return strings.ReplaceAll(s, secret, "<token>")
+	}
+	return s
+}
+
+// redactedError is an error whose message had the bot token removed. It unwraps to the cause of a *url.Error, which
+// has no URL in it, so errors.Is still tells e.g. a cancelled context.
+type redactedError struct {
+	message string
+	cause   error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.cause
+}
+
+// redactError returns err with the bot token removed from its message, as the errors of the HTTP client quote the
+// request URL and they end up in admin texts and alerts.
+func redactError(err error, secret string) error {
+	var cause error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		cause = urlErr.Err
+	}
+	return &redactedError{message: redactToken(err.Error(), secret), cause: cause}
+}
+
+// renderCalls renders captured calls compactly for the admin chat.
+func renderCalls(calls []outboundCall) string {
+	var b strings.Builder
+	for _, call := range calls {
+		fmt.Fprintf(&b, "%s %s %d %s", call.At.UTC().Format("15:04:05"), call.Method, call.Status, call.Duration.Round(time.Millisecond))
+		if call.Err != "" {
+			fmt.Fprintf(&b, " %s", call.Err)
+		}
+		fmt.Fprintf(&b, "\n→ %s\n← %s\n", call.Request, call.Response)
+	}
+	return TruncateText(b.String())
+}
+
+// truncateForLog cuts s to at most max bytes without splitting a UTF-8 sequence and marks how much was dropped.
+func truncateForLog(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s…(%d more bytes)", s[:cut], len(s)-cut)
+}
+
+// maskText hides free-text user input, keeping only the first and last character and the length. It counts
+// characters, not bytes, so Cyrillic and emoji are never cut in half.
+func maskText(s string) string {
+	runes := []rune(s)
+	switch {
+	case len(runes) == 0:
+		return ""
+	case len(runes) <= 2:
+		return fmt.Sprintf("… (%d)", len(runes))
+	}
+	return fmt.Sprintf("%c…%c (%d)", runes[0], runes[len(runes)-1], len(runes))
+}
+
+// Verbosity levels of the wrong password notification, selected with WRONG_PASSWORD_NOTIFY
+const (
+	notifyFull   string = "full"
+	notifyMasked string = "masked"
+	notifyCount  string = "count"
+)
+
+// wrongPasswordCounter counts wrong guesses per UTC day for the count-only verbosity.
+type wrongPasswordCounter struct {
+	mu    sync.Mutex
+	day   string
+	count int
+}
+
+var wrongPasswords = &wrongPasswordCounter{}
+
+func (c *wrongPasswordCounter) add(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != c.day {
+		c.day, c.count = day, 0
+	}
+	c.count++
+	return c.count
+}
+
+func (c *wrongPasswordCounter) today(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.UTC().Format("2006-01-02") != c.day {
+		return 0
+	}
+	return c.count
+}
+
+// wrongPasswordNotification returns the admin notification for a wrong guess according to the configured verbosity,
+// or false if the guess should only be counted. In full verbosity the links, mentions and formatting of the guess are
+// returned as entities of the notification, a masked guess has none.
+func wrongPasswordNotification(player string, m Message) (string, []MessageEntity, bool) {
+	switch wrongPasswordNotify {
+	case notifyMasked:
+		return renderAdminText(adminWrongPassword, adminData{Player: player, Text: maskText(m.Text), Media: mediaKind(m)}), nil, true
+	case notifyCount:
+		n := wrongPasswords.add(time.Now())
+		log.Printf("wrong password number %d today", n)
+		return "", nil, false
+	}
+	text := renderAdminText(adminWrongPassword, adminData{Player: player, Text: m.Text, Media: mediaKind(m)})
+	return text, shiftEntities(text, m.Text, m.Entities), true
+}
+
+// shiftEntities moves the entities of original to where it last appears in text, after the player name in the admin
+// texts, dropping those cut off when text is truncated. There are none if original isn't part of text.
+func shiftEntities(text string, original string, entities []MessageEntity) []MessageEntity {
+	i := strings.LastIndex(text, original)
+	if len(entities) == 0 || original == "" || i < 0 {
+		return nil
+	}
+	offset := utf16Length(text[:i])
+	limit := utf16Length(text)
+	if truncated := TruncateText(text); truncated != text {
+		limit = utf16Length(truncated) - utf16Length(Ellipsis)
+	}
+	var shifted []MessageEntity
+	for _, e := range entities {
+		e.Offset += offset
+		if e.Offset+e.Length <= limit {
+			shifted = append(shifted, e)
+		}
+	}
+	return shifted
+}
+
+// utf16Length is the length of s in the UTF-16 code units entity offsets are counted in.
+func utf16Length(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			// outside the basic plane, a surrogate pair
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Telegram limits on what the bot sends, in characters except for callback data which is limited in bytes.
+const MaxTextLength int = 4096
+const MaxCaptionLength int = 1024
+const MaxToastLength int = 200
+const MaxCallbackDataBytes int = 64
+
+// Ellipsis marks a text cut by one of the Truncate helpers.
+var Ellipsis string = "…"
+
+// TruncateText cuts a message text to the Telegram limit. The bot sends no parse_mode, so the only entities are those
+// relayed with SendTextWithEntities, which shiftEntities keeps within the cut.
+func TruncateText(s string) string {
+	return truncateRunes(s, MaxTextLength)
+}
+
+// TruncateCaption cuts a media caption to the Telegram limit.
+func TruncateCaption(s string) string {
+	return truncateRunes(s, MaxCaptionLength)
+}
+
+// checkCaption refuses captions Telegram would reject instead of cutting them, as they are written by hand.
+func checkCaption(caption string) error {
+	if n := utf8.RuneCountInString(caption); n > MaxCaptionLength {
+		return fmt.Errorf("caption is %d characters long, at most %d are allowed", n, MaxCaptionLength)
+	}
+	return nil
+}
+
+// TruncateToast cuts the text of an answerCallbackQuery notification to the Telegram limit.
+func TruncateToast(s string) string {
+	return truncateRunes(s, MaxToastLength)
+}
+
+// TruncateCallbackData cuts callback data to the byte limit on a rune boundary. There is no ellipsis, the data is
+// read back by the bot rather than by a person.
+func TruncateCallbackData(s string) string {
+	if len(s) <= MaxCallbackDataBytes {
+		return s
+	}
+	cut := MaxCallbackDataBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// truncateRunes cuts s to at most max characters, the Ellipsis included, never splitting a multi-byte character.
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	keep := max - utf8.RuneCountInString(Ellipsis)
+	if keep < 0 {
+		keep = 0
+	}
+	n := 0
+	for i := range s {
+		if n == keep {
+			return s[:i] + Ellipsis
+		}
+		n++
+	}
+	return s
+}
+
+// Limits Telegram puts on inline keyboards. Violations come back as opaque 400s, so we check before sending.
+const maxKeyboardButtons int = 100
+const maxKeyboardRowButtons int = 8
+const maxButtonTextLength int = 64
+
+// checkInlineKeyboard validates an inline keyboard against Telegram's limits and returns an error naming the offending
+// button. With autoWrap, rows longer than the per-row limit are split into several rows instead of being rejected.
+func checkInlineKeyboard(keyboard map[string][][]map[string]string, autoWrap bool) error {
+	rows := keyboard["inline_keyboard"]
+	if autoWrap {
+		var wrapped [][]map[string]string
+		for _, row := range rows {
+			for len(row) > maxKeyboardRowButtons {
+				wrapped = append(wrapped, row[:maxKeyboardRowButtons])
+				row = row[maxKeyboardRowButtons:]
+			}
+			wrapped = append(wrapped, row)
+		}
+		rows = wrapped
+		keyboard["inline_keyboard"] = rows
+	}
+
+	total := 0
+	for i, row := range rows {
+		if len(row) > maxKeyboardRowButtons {
+			return fmt.Errorf("keyboard row %d has %d buttons, at most %d are allowed", i, len(row), maxKeyboardRowButtons)
+		}
+		for j, button := range row {
+			if n := utf8.RuneCountInString(button["text"]); n == 0 || n > maxButtonTextLength {
+				return fmt.Errorf("button %q (row %d, column %d) has text of %d characters, 1 to %d are allowed", button["text"], i, j, n, maxButtonTextLength)
+			}
+			if data, ok := button["callback_data"]; ok && (len(data) == 0 || len(data) > MaxCallbackDataBytes) {
+				return fmt.Errorf("button %q (row %d, column %d) has callback data of %d bytes, 1 to %d are allowed", button["text"], i, j, len(data), MaxCallbackDataBytes)
+			}
+		}
+		total += len(row)
+	}
+	if total > maxKeyboardButtons {
+		return fmt.Errorf("keyboard has %d buttons, at most %d are allowed", total, maxKeyboardButtons)
+	}
+	return nil
+}
+
+// updateOutcome is the result of processing a single update.
+type updateOutcome struct {
+	At  time.Time
+	Err string
+}
+
+// errorRateTracker keeps a rolling window of update outcomes for this warm instance and decides when the admin
+// should be alerted about a failure spike.
+type errorRateTracker struct {
+	mu        sync.Mutex
+	threshold float64
+	window    time.Duration
+	mute      time.Duration
+	outcomes  []updateOutcome
+	lastAlert time.Time
+}
+
+var errorRate = &errorRateTracker{
+	threshold: envFloat(errorAlertThresholdEnv, 0.5),
+	window:    envDuration(errorAlertWindowEnv, 10*time.Minute),
+	mute:      envDuration(errorAlertMuteEnv, time.Hour),
+}
+
+// record adds the outcome of an update to the window and returns the alert text when the failure ratio crosses the
+// threshold and we are not inside the muted period after the previous alert.
+func (t *errorRateTracker) record(now time.Time, err error) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	outcome := updateOutcome{At: now}
+	if err != nil {
+		outcome.Err = err.Error()
+	}
+	t.outcomes = append(t.outcomes, outcome)
+
+	// drop everything that fell out of the window
+	first := 0
+	for first < len(t.outcomes) && now.Sub(t.outcomes[first].At) > t.window {
+		first++
+	}
+	t.outcomes = t.outcomes[first:]
+
+	if err == nil || len(t.outcomes) < errorAlertMinUpdates {
+		return "", false
+	}
+	if !t.lastAlert.IsZero() && now.Sub(t.lastAlert) < t.mute {
+		return "", false
+	}
+
+	counts := make(map[string]int)
+	for _, o := range t.outcomes {
+		if o.Err != "" {
+			counts[o.Err]++
+		}
+	}
+	failures := 0
+	for _, c := range counts {
+		failures += c
+	}
+	ratio := float64(failures) / float64(len(t.outcomes))
+	if ratio < t.threshold {
+		return "", false
+	}
+	t.lastAlert = now
+
+	messages := make([]string, 0, len(counts))
+	for m := range counts {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if counts[messages[i]] != counts[messages[j]] {
+			return counts[messages[i]] > counts[messages[j]]
+		}
+		return messages[i] < messages[j]
+	})
+	if len(messages) > 3 {
+		messages = messages[:3]
+	}
+
+	data := adminData{Count: failures, Total: len(t.outcomes), Window: t.window}
+	for _, m := range messages {
+		data.Errors = append(data.Errors, fmt.Sprintf("%dx %s", counts[m], m))
+	}
+	return renderAdminText(adminErrorSpike, data), true
+}
+
+// recentErrors returns the distinct errors of the window, the most frequent first, at most n.
+func (t *errorRateTracker) recentErrors(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int)
+	var messages []string
+	for _, o := range t.outcomes {
+		if o.Err == "" {
+			continue
+		}
+		if counts[o.Err] == 0 {
+			messages = append(messages, o.Err)
+		}
+		counts[o.Err]++
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return counts[messages[i]] > counts[messages[j]]
+	})
+	if len(messages) > n {
+		messages = messages[:n]
+	}
+	return messages
+}
+
+// sendErrorAlert posts the alert straight to the admin chat, skipping the usual send helpers which may be exactly
+// what is failing.
+func sendErrorAlert(ctx context.Context, text string) {
+	response, err := defaultClient().postForm(
+		ctx,
+		telegramApiSendMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(ANTON_CHAT_ID)},
+			"text": {text},
+		},
+	)
+	if err != nil {
+		log.Printf("could not send error alert: %s", err.Error())
+		return
+	}
+	defer response.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+}
+
+// recordUpdateOutcome feeds the error rate tracker and alerts the admin on a spike.
+func recordUpdateOutcome(ctx context.Context, err error) {
+	if text, alert := errorRate.record(time.Now(), err); alert {
+		log.Printf("error rate alert: %s", text)
+		sendErrorAlert(ctx, text)
+	}
+}
+
+// UpdateKind classifies what an update turned out to be.
+type UpdateKind string
+
+const (
+	KindCommand      UpdateKind = "command"
+	KindPassword     UpdateKind = "password"
+	KindLocation     UpdateKind = "location"
+	KindVoice        UpdateKind = "voice"
+	KindAudio        UpdateKind = "audio"
+	KindPollAnswer   UpdateKind = "poll_answer"
+	KindSticker      UpdateKind = "sticker"
+	KindUnauthorized UpdateKind = "ignored-unauthorized"
+	KindDuplicate    UpdateKind = "duplicate"
+	KindUnrecognized UpdateKind = "unrecognized"
+	KindStale        UpdateKind = "ignored-stale"
+)
+
+// Action is a single outbound Telegram call, either performed while processing an update or planned as the webhook
+// reply.
+type Action struct {
+	Method   string
+	ChatId   int
+	Text     string
+	Admin    bool
+	Optional bool
+	Err      error
+}
+
+// MarshalJSON renders the action as a method call Telegram accepts as the body of a webhook reply.
+func (a Action) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"method":  a.Method,
+		"chat_id": a.ChatId,
+		"text":    a.Text,
+	})
+}
+
+// Result is what ProcessUpdate did with an update.
+type Result struct {
+	Kind    UpdateKind
+	Actions []Action
+	// Reply, if set, is not performed yet and should be sent back as the webhook response.
+	Reply *Action
+	// Trace explains how the update was handled, including why nothing was done.
+	Trace Trace
+	// Muted is set when the admin muted the chat, its admin notifications are then only logged and traced.
+	Muted bool
+	// alerts are the alerts raised for the update still being sent, see raiseAlert.
+	alerts *sync.WaitGroup
+}
+
+// pendingAlerts returns the alerts raised for the update, to raise one more or wait for them.
+func (res *Result) pendingAlerts() *sync.WaitGroup {
+	if res.alerts == nil {
+		res.alerts = &sync.WaitGroup{}
+	}
+	return res.alerts
+}
+
+const maxTraceEntries int = 32
+
+// Trace is the ordered list of decisions taken for an update, e.g. "auth=ok dedup=miss branch=location matches=0".
+// It keeps at most maxTraceEntries decisions and counts the rest.
+type Trace struct {
+	entries []string
+	dropped int
+}
+
+func (t *Trace) add(key string, value string) {
+	if len(t.entries) >= maxTraceEntries {
+		t.dropped++
+		return
+	}
+	t.entries = append(t.entries, key+"="+value)
+}
+
+// Entries returns the recorded decisions in order.
+func (t Trace) Entries() []string {
+	return t.entries
+}
+
+// Implements the fmt.String interface to log the trace as a single line.
+func (t Trace) String() string {
+	s := strings.Join(t.entries, " ")
+	if t.dropped > 0 {
+		s += fmt.Sprintf(" (+%d more)", t.dropped)
+	}
+	return s
+}
+
+type traceKey struct{}
+
+// trace records a decision in the trace carried by ctx, if any.
+func trace(ctx context.Context, key string, value string) {
+	if t, ok := ctx.Value(traceKey{}).(*Trace); ok {
+		t.add(key, value)
+	}
+}
+
+// traceDebug records a decision whose value needs formatting, only in debug mode so the formatting costs nothing
+// otherwise.
+func traceDebug(ctx context.Context, key string, format string, args ...interface{}) {
+	if logDebug {
+		trace(ctx, key, fmt.Sprintf(format, args...))
+	}
+}
+
+// record appends an action performed through one of the send helpers and logs its outcome.
+func (res *Result) record(a Action, body string) {
+	res.Actions = append(res.Actions, a)
+	if a.Err != nil {
+		log.Printf("got error %s from telegram, response body is %s", a.Err.Error(), body)
+	} else {
+		log.Printf("successfully distributed to chat id %d", a.ChatId)
+	}
+}
+
+func (res *Result) sendText(ctx context.Context, chatId int, text string) {
+	body, err := sendTextMessage(ctx, chatId, text)
+	res.record(Action{Method: "sendMessage", ChatId: chatId, Text: text, Err: err}, body)
+}
+
+func (res *Result) sendTextWithKeyboard(ctx context.Context, chatId int, text string, keyboard map[string][][]map[string]string) {
+	body, err := sendTextMessageWithKeyboard(ctx, chatId, text, keyboard)
+	res.record(Action{Method: "sendMessage", ChatId: chatId, Text: text, Err: err}, body)
+}
+
+func (res *Result) sendLocation(ctx context.Context, chatId int, l Location) {
+	body, err := sendLocationMessage(ctx, chatId, l)
+	res.record(Action{Method: "sendLocation", ChatId: chatId, Err: err}, body)
+}
+
+// sendMapPreview sends the static map of a clue. It is optional: a failure doesn't fail the update.
+func (res *Result) sendMapPreview(ctx context.Context, chatId int, l Location, radius float64) {
+	photo, ok := staticMapURL(l, radius)
+	if !ok {
+		return
+	}
+	body, err := sendPhotoMessage(ctx, chatId, photo, "")
+	res.record(Action{Method: "sendPhoto", ChatId: chatId, Optional: true, Err: err}, body)
+}
+
+// sendQuiz sends the quiz as a non-anonymous poll, so the answer tells who gave it, and remembers it for the answer.
+func (res *Result) sendQuiz(ctx context.Context, chatId int, q *Quiz) {
+	body, err := sendPollMessage(ctx, chatId, q.Question, q.Options, true, q.Correct)
+	if err == nil {
+		var pollId string
+		if pollId, err = telegramPollId(body); err == nil {
+			polls.add(pollId, quizPoll{ChatId: chatId, Quiz: q})
+		}
+	}
+	res.record(Action{Method: "sendPoll", ChatId: chatId, Text: q.Question, Err: err}, body)
+}
+
+// sendPlayerPreview sends a player-facing message labeled with its id, a quiz after a label of its own since a poll
+// can't carry one. A message that can't be sent as configured is replaced by its error.
+func (res *Result) sendPlayerPreview(ctx context.Context, chatId int, p playerPreview) {
+	label := "[" + p.Id + "]"
+	switch {
+	case p.Err != nil:
+		res.sendText(ctx, chatId, label+"\n"+renderAdminText(adminRenderError, adminData{Error: p.Err.Error()}))
+	case p.Quiz != nil:
+		res.sendText(ctx, chatId, label)
+		// not remembered in polls, answering a preview must not run the quiz actions for the admin
+		body, err := sendPollMessage(ctx, chatId, p.Quiz.Question, p.Quiz.Options, true, p.Quiz.Correct)
+		res.record(Action{Method: "sendPoll", ChatId: chatId, Text: p.Quiz.Question, Err: err}, body)
+	case p.Keyboard != nil:
+		res.sendTextWithKeyboard(ctx, chatId, label+"\n"+p.Text, p.Keyboard)
+	default:
+		res.sendText(ctx, chatId, label+"\n"+p.Text)
+	}
+}
+
+// forwardVoice sends a voice note of a player to the admin chat, unless notifications are muted. It reports whether
+// the admin got it.
+func (res *Result) forwardVoice(ctx context.Context, v Voice) bool {
+	if res.Muted {
+		res.Trace.add("voice", "muted")
+		return false
+	}
+	body, err := sendVoiceMessage(ctx, ANTON_CHAT_ID, v.FileId)
+	res.record(Action{Method: "sendVoice", ChatId: ANTON_CHAT_ID, Admin: true, Err: err}, body)
+	return err == nil
+}
+
+// forwardAudio sends an audio file of a player to the admin chat, unless notifications are muted. It reports whether
+// the admin got it.
+func (res *Result) forwardAudio(ctx context.Context, a Audio) bool {
+	if res.Muted {
+		res.Trace.add("audio", "muted")
+		return false
+	}
+	body, err := sendAudioMessage(ctx, ANTON_CHAT_ID, a.FileId, a.Duration)
+	res.record(Action{Method: "sendAudio", ChatId: ANTON_CHAT_ID, Admin: true, Err: err}, body)
+	return err == nil
+}
+
+func (res *Result) sendDocument(ctx context.Context, chatId int, document string, caption string) {
+	var body string
+	var err error
+	if isLocalFile(document) {
+		var file *os.File
+		if file, err = os.Open(document); err == nil {
+			body, err = sendDocumentMessage(ctx, chatId, filepath.Base(document), file, caption)
+			file.Close()
+		}
+	} else {
+		body, err = sendDocumentByIdMessage(ctx, chatId, document, caption)
+	}
+	res.record(Action{Method: "sendDocument", ChatId: chatId, Text: caption, Err: err}, body)
+}
+
+// sendContact shares the contact card with the chat and returns the error, to be reported back to the admin. It is
+// optional as that report is all the admin needs to hear about a failure.
+func (res *Result) sendContact(ctx context.Context, chatId int, c Contact) error {
+	body, err := sendContactMessage(ctx, chatId, c.Phone, c.FirstName, c.LastName)
+	res.record(Action{Method: "sendContact", ChatId: chatId, Text: c.FirstName, Optional: true, Err: err}, body)
+	return err
+}
+
+// sendClue sends the location t, as a venue if it has a title.
+func (res *Result) sendClue(ctx context.Context, chatId int, t int) {
+	venue := LOCATION_VENUES[t]
+	if venue.Title == "" {
+		res.sendLocation(ctx, chatId, LOCATIONS[t])
+		return
+	}
+	body, err := sendVenueMessage(ctx, chatId, LOCATIONS[t], venue.Title, venue.Address)
+	res.record(Action{Method: "sendVenue", ChatId: chatId, Text: venue.Title, Err: err}, body)
+}
+
+// sendLocationPhoto sends the photo of the location t, if it has one. Like the map preview it is optional.
+func (res *Result) sendLocationPhoto(ctx context.Context, chatId int, t int) {
+	photo := LOCATION_PHOTOS[t]
+	if photo.Photo == "" {
+		return
+	}
+	body, err := sendPhotoMessage(ctx, chatId, photo.Photo, photo.Caption)
+	res.record(Action{Method: "sendPhoto", ChatId: chatId, Optional: true, Err: err}, body)
+}
+
+// mirrorLocation mirrors the location of a player to the admin chat: the first ping sends a live location, the next
+// ones edit it at most once per liveLocationEditInterval, and it is sent anew once expired or when an edit fails.
+func (res *Result) mirrorLocation(ctx context.Context, chatId int, player string, l Location) {
+	if !adminLiveLocation || res.Muted {
+		return
+	}
+	now := time.Now()
+	messageId, skip := mirrors.next(chatId, now)
+	if skip {
+		res.Trace.add("mirror", "throttled")
+		return
+	}
+	if messageId != 0 {
+		body, err := editLiveLocationMessage(ctx, ANTON_CHAT_ID, messageId, l)
+		if err == nil {
+			_, err = telegramMessageId(body)
+		}
+		res.record(Action{Method: "editMessageLiveLocation", ChatId: ANTON_CHAT_ID, Admin: true, Err: err}, body)
+		if err == nil {
+			res.Trace.add("mirror", "edited")
+			mirrors.edited(chatId, now)
+			return
+		}
+	}
+	res.notifyAdmin(ctx, renderAdminText(adminMirror, adminData{Player: player}))
+	body, err := sendLiveLocationMessage(ctx, ANTON_CHAT_ID, l, adminLivePeriod)
+	var sentId int
+	if err == nil {
+		sentId, err = telegramMessageId(body)
+	}
+	res.record(Action{Method: "sendLocation", ChatId: ANTON_CHAT_ID, Admin: true, Err: err}, body)
+	if err != nil {
+		mirrors.forget(chatId)
+		return
+	}
+	res.Trace.add("mirror", "sent")
+	mirrors.sent(chatId, sentId, now, adminLivePeriod)
+}
+
+func (res *Result) notifyAdmin(ctx context.Context, text string) {
+	res.notifyAdminWithEntities(ctx, text, nil)
+}
+
+// notifyAdminWithEntities is notifyAdmin formatting the text with the entities, e.g. those of a relayed user message.
+func (res *Result) notifyAdminWithEntities(ctx context.Context, text string, entities []MessageEntity) {
+	if res.Muted {
+		log.Printf("admin notification muted: %s", text)
+		res.Trace.add("admin", "muted")
+		return
+	}
+	var body string
+	var err error
+	if len(entities) > 0 {
+		body, err = sendTextMessageWithEntities(ctx, ANTON_CHAT_ID, text, entities)
+	} else {
+		body, err = sendTextMessage(ctx, ANTON_CHAT_ID, text)
+	}
+	res.record(Action{Method: "sendMessage", ChatId: ANTON_CHAT_ID, Text: text, Admin: true, Err: err}, body)
+}
+
+// Err returns the first failed user-facing action. Failed admin notifications and optional actions don't fail the
+// update.
+func (res *Result) Err() error {
+	for _, a := range res.Actions {
+		if a.Err != nil && !a.Admin && !a.Optional && !errors.Is(a.Err, ErrBudgetExceeded) {
+			return a.Err
+		}
+	}
+	return nil
+}
+
+// recentUpdates remembers the last update ids seen by this warm instance, so redeliveries are not processed twice.
+type recentUpdates struct {
+	mu   sync.Mutex
+	ids  [100]int
+	next int
+}
+
+var seenUpdates = &recentUpdates{}
+
+// Replay protection, both checks are off unless configured since a backfill after downtime legitimately delivers old
+// updates. Updates more than updateIdTolerance below the highest update id seen are rejected, if it is not negative.
+// Messages older than maxMessageAge are rejected, if it is set.
+var updateIdTolerance int = envInt(updateIdToleranceEnv, -1)
+var maxMessageAge time.Duration = envDuration(maxMessageAgeEnv, 0)
+
+// updateWatermark is the highest update id seen by this warm instance, the bot has no store to keep it in.
+type updateWatermark struct {
+	mu   sync.Mutex
+	high int
+}
+
+var watermark = &updateWatermark{}
+
+// advance raises the watermark to the update id and returns false if the id is too far below it.
+func (w *updateWatermark) advance(id int, tolerance int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if id < w.high-tolerance {
+		return false
+	}
+	if id > w.high {
+		w.high = id
+	}
+	return true
+}
+
+// staleUpdate returns why an update is rejected as a replay, or "" to process it.
+func staleUpdate(update *Update, now time.Time) string {
+	if updateIdTolerance >= 0 && !watermark.advance(update.UpdateId, updateIdTolerance) {
+		return "watermark"
+	}
+	if maxMessageAge > 0 && update.Message.Date > 0 {
+		if age := now.Sub(time.Unix(update.Message.Date, 0)); age > maxMessageAge {
+			log.Printf("warning: message of update %d is %s old", update.UpdateId, age.Round(time.Second))
+			return "age"
+		}
+	}
+	return ""
+}
+
+// seen records id and tells whether it was already recorded.
+func (r *recentUpdates) seen(id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.ids {
+		if s == id {
+			return true
+		}
+	}
+	r.ids[r.next] = id
+	r.next = (r.next + 1) % len(r.ids)
+	return false
+}
+
+// ErrChatBusy is returned when another update of the same chat held the chat lock for too long.
+var ErrChatBusy = errors.New("chat is busy with another update")
+
+// ErrUnauthorized is returned for Telegram calls while the bot token is rejected.
+var ErrUnauthorized = errors.New("telegram rejects the bot token")
+
+// tokenState tracks whether Telegram accepts the bot token. Once a call gets a 401, calls fail fast for
+// tokenRetryInterval, then the next one goes through to check whether the token works again.
+type tokenState struct {
+	mu            sync.Mutex
+	rejectedUntil time.Time
+	rejected      bool
+	alerted       time.Time
+}
+
+var token = &tokenState{}
+
+// check returns ErrUnauthorized while calls should fail fast.
+func (t *tokenState) check(now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Before(t.rejectedUntil) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// unauthorized records a 401 and returns true if the side-channel alert is due, at most once per tokenAlertInterval.
+func (t *tokenState) unauthorized(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rejected = true
+	t.rejectedUntil = now.Add(tokenRetryInterval)
+	if !t.alerted.IsZero() && now.Sub(t.alerted) < tokenAlertInterval {
+		return false
+	}
+	t.alerted = now
+	return true
+}
+
+// authorized records a call the token was accepted for and returns true if it was rejected before.
+func (t *tokenState) authorized() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recovered := t.rejected
+	t.rejected = false
+	t.rejectedUntil = time.Time{}
+	return recovered
+}
+
+// sendSideChannelAlert posts the text to the alert webhook, which doesn't depend on the bot token.
+func sendSideChannelAlert(text string) {
+	if alertWebhookUrl == "" {
+		log.Printf("no %s to send the alert to: %s", alertWebhookUrlEnv, text)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertBudget)
+	defer cancel()
+	if err := (WebhookChannel{URL: alertWebhookUrl}).Send(ctx, text); err != nil {
+		log.Printf("could not send the alert: %s", err.Error())
+	}
+}
+
+// AlertChannel delivers critical events outside of Telegram, for when the admin doesn't watch the admin chat.
+type AlertChannel interface {
+	Name() string
+	Send(ctx context.Context, text string) error
+}
+
+// WebhookChannel posts {"text": ...} to an incoming webhook, e.g. Google Chat or Slack.
+type WebhookChannel struct {
+	URL string
+}
+
+func (c WebhookChannel) Name() string {
+	return "webhook"
+}
+
+func (c WebhookChannel) Send(ctx context.Context, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return doAlertRequest(request)
+}
+
+// EmailChannel sends an email through an HTTP email API taking a form with from, to, subject and text fields and the
+// API key as basic auth password, like the Mailgun messages endpoint.
+type EmailChannel struct {
+	URL    string
+	APIKey string
+	From   string
+	To     string
+}
+
+func (c EmailChannel) Name() string {
+	return "email"
+}
+
+func (c EmailChannel) Send(ctx context.Context, text string) error {
+	form := url.Values{
+		"from":    {c.From},
+		"to":      {c.To},
+		"subject": {"Квест: " + text},
+		"text":    {text},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("api", c.APIKey)
+	return doAlertRequest(request)
+}
+
+func doAlertRequest(request *http.Request) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", request.URL.Host, response.Status)
+	}
+	return nil
+}
+
+// ALERT_CHANNELS are configured from the environment: the webhook of ALERT_WEBHOOK_URL and the email API of
+// ALERT_EMAIL_API_URL. ALERT_EVENTS lists the admin events sent to them, comma separated, "completed" by default.
+var ALERT_CHANNELS []AlertChannel
+var alertEvents = make(map[string]bool)
+
+func init() {
+	if alertWebhookUrl != "" {
+		ALERT_CHANNELS = append(ALERT_CHANNELS, WebhookChannel{URL: alertWebhookUrl})
+	}
+	if emailUrl := os.Getenv(alertEmailApiUrlEnv); emailUrl != "" {
+		channel := EmailChannel{URL: emailUrl, APIKey: os.Getenv(alertEmailApiKeyEnv), From: os.Getenv(alertEmailFromEnv), To: os.Getenv(alertEmailToEnv)}
+		if channel.From == "" || channel.To == "" {
+			log.Fatalf("%s needs %s and %s", alertEmailApiUrlEnv, alertEmailFromEnv, alertEmailToEnv)
+		}
+		ALERT_CHANNELS = append(ALERT_CHANNELS, channel)
+	}
+	events := os.Getenv(alertEventsEnv)
+	if events == "" {
+		events = adminCompleted
+	}
+	for _, event := range strings.Split(events, ",") {
+		alertEvents[strings.TrimSpace(event)] = true
+	}
+}
+
+// raiseAlert sends the text of a critical event to every alert channel in the background, so neither a slow channel
+// nor its retries hold up the player. The request raising it waits for pending before answering, so the instance
+// isn't frozen with them, and only for its own alerts.
+func raiseAlert(pending *sync.WaitGroup, event string, text string) {
+	if !alertEvents[event] {
+		return
+	}
+	for _, channel := range ALERT_CHANNELS {
+		pending.Add(1)
+		go func(channel AlertChannel) {
+			defer pending.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), alertBudget)
+			defer cancel()
+			if err := sendAlertWithRetry(ctx, channel, text, alertBackoff); err != nil {
+				log.Printf("could not send %s alert through %s: %s", event, channel.Name(), err.Error())
+			}
+		}(channel)
+	}
+}
+
+type alertsKey struct{}
+
+// withPendingAlerts carries the alerts of a request in ctx, for alerts raised deep in the send path.
+func withPendingAlerts(ctx context.Context, pending *sync.WaitGroup) context.Context {
+	return context.WithValue(ctx, alertsKey{}, pending)
+}
+
+// dispatchAlert runs send in the background, tracked by the alerts carried in ctx so the request waits for it before
+// returning. Without any it runs send right away, as nobody would wait for it otherwise.
+func dispatchAlert(ctx context.Context, send func()) {
+	pending, ok := ctx.Value(alertsKey{}).(*sync.WaitGroup)
+	if !ok {
+		send()
+		return
+	}
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		send()
+	}()
+}
+
+// sendAlertWithRetry makes up to alertAttempts attempts, waiting a backoff longer after each failure.
+func sendAlertWithRetry(ctx context.Context, channel AlertChannel, text string, backoff time.Duration) error {
+	var err error
+	for attempt := 1; attempt <= alertAttempts; attempt++ {
+		if err = channel.Send(ctx, text); err == nil {
+			return nil
+		}
+		log.Printf("alert through %s failed, attempt %d: %s", channel.Name(), attempt, err.Error())
+		if attempt == alertAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff * time.Duration(attempt)):
+		}
+	}
+	return err
+}
+
+type chatLock struct {
+	held chan struct{}
+	refs int
+}
+
+// chatLocks serializes updates of the same chat within this warm instance, so the read-modify-write of per-chat state
+// doesn't interleave when Telegram delivers two updates concurrently.
+type chatLocks struct {
+	mu    sync.Mutex
+	locks map[int]*chatLock
+}
+
+var chats = &chatLocks{locks: make(map[int]*chatLock)}
+
+// acquire waits for the lock of the chat until ctx is done and returns the function releasing it.
+func (c *chatLocks) acquire(ctx context.Context, chatId int) (func(), error) {
+	c.mu.Lock()
+	l, ok := c.locks[chatId]
+	if !ok {
+		l = &chatLock{held: make(chan struct{}, 1)}
+		c.locks[chatId] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			c.unref(chatId, l)
+		}, nil
+	case <-ctx.Done():
+		c.unref(chatId, l)
+		return nil, ErrChatBusy
+	}
+}
+
+// unref forgets the lock of the chat once nobody holds or waits for it.
+func (c *chatLocks) unref(chatId int, l *chatLock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(c.locks, chatId)
+	}
+}
+
+// HandleTelegramWebHook processes the update and translates the result into the webhook response. Telegram redelivers
+// any update not answered with 200, so failures are only logged and counted, except a busy chat which we do want
+// redelivered.
+func HandleTelegramWebHook(w http.ResponseWriter, r *http.Request) {
+
+	// Parse incoming request
+	var update, err = parseTelegramRequest(r)
+	if err != nil {
+		log.Printf("error parsing update, %s", err.Error())
+		recordUpdateOutcome(r.Context(), err)
+		return
+	}
+
+	result, err := ProcessUpdate(r.Context(), update)
+	recordUpdateOutcome(r.Context(), err)
+	if errors.Is(err, ErrChatBusy) {
+		log.Printf("chat %d is busy, asking telegram to redeliver update %d", update.Message.Chat.Id, update.UpdateId)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || result.Kind == KindUnrecognized {
+		notifyRawUpdate(r.Context(), update, err)
+	}
+	log.Printf("Update new is %s, processed as %s with %d actions", update, result.Kind, len(result.Actions));
+	log.Printf("decision trace of update %d: %s", update.UpdateId, result.Trace)
+
+	if result.Reply != nil {
+		// the reply is a send like any other, so it counts against the daily budget too
+		if err := outbound.spend(r.Context(), time.Now()); err != nil {
+			log.Printf("dropping the reply to chat %d: %s", result.Reply.ChatId, err.Error())
+			result.Reply = nil
+		}
+	}
+	if result.Reply != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result.Reply); err != nil {
+			log.Printf("could not write webhook reply: %s", err.Error())
+		}
+	}
+	result.pendingAlerts().Wait()
+}
+
+// emergencyRequest is the body HandleEmergencySend expects.
+type emergencyRequest struct {
+	ChatId int    `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// HandleEmergencySend is a separate function to send a text to a chat when the update handling misbehaves during a
+// game. It calls sendMessage directly and nothing else runs: no dedup, no locks, no handlers. Requests must carry
+// EMERGENCY_SECRET in the X-Emergency-Secret header and it answers 404 while EMERGENCY_SECRET is not set. Every use is
+// reported to the admin chat and the alert channels.
+func HandleEmergencySend(w http.ResponseWriter, r *http.Request) {
+	if emergencySecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(emergencySecretHeader)), []byte(emergencySecret)) != 1 {
+		log.Printf("EMERGENCY SEND REJECTED: wrong secret from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var request emergencyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ChatId == 0 || request.Text == "" {
+		http.Error(w, `expected {"chat_id": <int>, "text": <string>}`, http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("EMERGENCY SEND to chat %d: %s", request.ChatId, request.Text)
+	var pending sync.WaitGroup
+	ctx := withPendingAlerts(r.Context(), &pending)
+	data := adminData{ChatId: request.ChatId, Text: request.Text}
+	status := http.StatusOK
+	if err := emergencySend(ctx, request.ChatId, request.Text); err != nil {
+		log.Printf("EMERGENCY SEND to chat %d FAILED: %s", request.ChatId, err.Error())
+		data.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	text := renderAdminText(adminEmergency, data)
+	if request.ChatId != ANTON_CHAT_ID {
+		if err := emergencySend(ctx, ANTON_CHAT_ID, text); err != nil {
+			log.Printf("could not report the emergency send to the admin: %s", err.Error())
+		}
+	}
+	raiseAlert(&pending, adminEmergency, text)
+	pending.Wait()
+	w.WriteHeader(status)
+}
+
+// emergencySend posts a bare sendMessage, see HandleEmergencySend.
+func emergencySend(ctx context.Context, chatId int, text string) error {
+	_, err := readSendResponse(defaultClient().postForm(ctx,
+		telegramApiSendMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"text": {TruncateText(text)},
+		},
+	))
+	return err
+}
+
+// notifyRawUpdate shows the admin the original JSON of an update that failed or that we couldn't recognize, so new
+// Telegram fields can be inspected without a redeploy. The JSON is only there when raw capture mode is on; without it
+// the admin still hears about failures, just without the payload.
+func notifyRawUpdate(ctx context.Context, update *Update, err error) {
+	raw := update.Raw()
+	if err == nil && (raw == nil || harmlessUpdate(update)) {
+		return
+	}
+	data := adminData{UpdateId: update.UpdateId}
+	if raw != nil {
+		data.Text = truncateForLog(string(raw), rawNotifyMaxLength)
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	text := renderAdminText(adminUpdateFailed, data)
+	var telegramResponseBody, errTelegram = sendTextMessage(ctx, ANTON_CHAT_ID, text)
+	if errTelegram != nil {
+		log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
+	}
+}
+
+// harmlessUpdate tells whether an update we don't handle is known to need no attention, like the edited message
+// Telegram sends for every move of a live location.
+func harmlessUpdate(update *Update) bool {
+	_, ok := update.GetRawPath("edited_message.location")
+	return ok
+}
+
+// fastPathUpdates counts the updates answered by fastPath since the instance started.
+var fastPathUpdates int64
+
+// fastPath recognizes updates from known strangers which the full path would ignore, so they skip the chat lock, the
+// dedup ring and the handlers. It must stay conservative: anything that could send or change state, e.g. a /start
+// or the first message of a stranger, goes through the full path.
+func fastPath(m Message) bool {
+	if m.Chat.Id == ANTON_CHAT_ID || isAllowed(m.Chat.Username) {
+		return false
+	}
+	if isStart, _ := parseStartCommand(m.Text); isStart {
+		return false
+	}
+	return strangers.known(m.Chat.Id)
+}
+
+// ProcessUpdate runs the bot logic for a single update and reports what was done.
+func ProcessUpdate(ctx context.Context, update *Update) (Result, error) {
+	var res Result
+	ctx = context.WithValue(ctx, traceKey{}, &res.Trace)
+	ctx = withPendingAlerts(ctx, res.pendingAlerts())
+
+	if update.PollAnswer.PollId != "" {
+		if seenUpdates.seen(update.UpdateId) {
+			res.Kind = KindDuplicate
+			trace(ctx, "dedup", "hit")
+			return res, nil
+		}
+		handlePollAnswer(ctx, &res, update.PollAnswer)
+		return res, res.Err()
+	}
+	if update.Message.Chat.Id == 0 {
+		// not a message, e.g. an edited message or a kind of update we don't model
+		res.Kind = KindUnrecognized
+		trace(ctx, "branch", "unrecognized")
+		return res, nil
+	}
+	if fastPath(update.Message) {
+		atomic.AddInt64(&fastPathUpdates, 1)
+		res.Kind = KindUnauthorized
+		trace(ctx, "fastpath", "stranger")
+		return res, nil
+	}
+
+	// Only mark the update as seen once we hold the chat, a busy chat gets it redelivered
+	lockCtx, cancel := context.WithTimeout(ctx, chatLockTimeout)
+	defer cancel()
+	release, err := chats.acquire(lockCtx, update.Message.Chat.Id)
+	if err != nil {
+		trace(ctx, "lock", "busy")
+		return res, err
+	}
+	defer release()
+
+	if seenUpdates.seen(update.UpdateId) {
+		res.Kind = KindDuplicate
+		trace(ctx, "dedup", "hit")
+		return res, nil
+	}
+	trace(ctx, "dedup", "miss")
+	if reason := staleUpdate(update, time.Now()); reason != "" {
+		res.Kind = KindStale
+		trace(ctx, "stale", reason)
+		return res, nil
+	}
+
+	res.Muted = muted.has(update.Message.Chat.Id)
+	if handleAdminCommand(ctx, &res, update.Message) {
+		return res, res.Err()
+	}
+
+	if isStart, payload := parseStartCommand(update.Message.Text); isStart {
+		// a referral lets the invited friend in, so it has to be read before the allowlist check
+		if _, referrer := matchStartPayload(payload); referrer != "" && invites.add(update.Message.Chat.Username, referrer) {
+			trace(ctx, "invite", "accepted")
+		}
+	}
+	if (!isAllowed(update.Message.Chat.Username)) {
+		res.Kind = KindUnauthorized
+		trace(ctx, "auth", "stranger")
+		handleStranger(ctx, &res, update.Message)
+		return res, res.Err()
+	}
+	trace(ctx, "auth", "ok")
+	activity.seen(update.Message, time.Now())
+
+	chatId := update.Message.Chat.Id
+	player := displayName(update.Message.Chat.Username)
+	if isStart, payload := parseStartCommand(update.Message.Text); isStart {
+		res.Kind = KindCommand
+		trace(ctx, "branch", "start")
+		res.sendText(ctx, chatId, START_TEXT)
+		data := adminData{Player: player}
+		if campaign, referrer := matchStartPayload(payload); referrer != "" {
+			trace(ctx, "payload", "referral")
+			data.Referrer = displayName(referrer)
+		} else if campaign != "" {
+			trace(ctx, "payload", "campaign")
+			data.Campaign = campaign
+		} else if payload != "" {
+			trace(ctx, "payload", "unknown")
+		}
+		res.notifyAdmin(ctx, renderAdminText(adminStarted, data))
+	} else if commandName(update.Message.Text) == "/unlock" {
+		res.Kind = KindCommand
+		trace(ctx, "branch", "unlock")
+		res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: "Пароль?"}
+	} else if commandName(update.Message.Text) == "/whoami" {
+		res.Kind = KindCommand
+		trace(ctx, "branch", "whoami")
+		res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: whoamiText(chatId, time.Now(), false)}
+	} else if actions, transform, ok := matchPassword(update.Message.Text); ok {
+		res.Kind = KindPassword
+		trace(ctx, "branch", "password")
+		if transform != "" {
+			trace(ctx, "transform", transform)
+			text := update.Message.Text
+			if wrongPasswordNotify == notifyMasked {
+				text = maskText(text)
+			}
+			res.notifyAdmin(ctx, renderAdminText(adminTransformed, adminData{Player: player, Text: text, Transform: transform}))
+		}
+		runPasswordActions(ctx, &res, chatId, update.Message.Chat.Username, actions)
+	} else if (update.Message.Location.Latitude > 0) {
+		res.Kind = KindLocation
+		trace(ctx, "branch", "location")
+		for _, transition := range zones.transitions(GEODESIC, chatId, update.Message.Location) {
+			event := adminZoneLeft
+			if transition.Entered {
+				event = adminZoneEntered
+			}
+			res.notifyAdmin(ctx, renderAdminText(event, adminData{Player: player, Zone: transition.Zone}))
+		}
+		res.mirrorLocation(ctx, chatId, player, update.Message.Location)
+		nearest := nearestDistance(GEODESIC, update.Message.Location)
+		tier := pickDistanceTier(DISTANCE_TIERS[:], nearest)
+		traceDebug(ctx, "nearest", "%.0f", nearest)
+		if reveal, ok := pickRevealTier(DISTANCE_TIERS[:], nearest); ok && !tier.Reveal {
+			// a nearer tier without reveal only adds its text, the clues are revealed as by the farther tier
+			res.sendText(ctx, chatId, tier.Text)
+			tier = reveal
+		}
+		if (tier.Reveal) {
+			matches := 0
+			for t, l := range LOCATIONS {
+				if distance := GEODESIC.Distance(l, update.Message.Location); distance < tier.MaxDistance {
+					if hours := locationHours[t]; hours != nil && !hours.Open(time.Now()) {
+						trace(ctx, "closed", locationName(t))
+						res.sendText(ctx, chatId, closedText(hours, time.Now()))
+						res.notifyAdmin(ctx, renderAdminText(adminClosed, adminData{Player: player, Location: locationName(t), Distance: distance}))
+						continue
+					}
+					if inner := LOCATION_INNER_RADII[t]; inner > 0 && distance >= inner {
+						res.sendText(ctx, chatId, "Ты рядом, подойди ближе")
+						if nearMisses.first(chatId, t) {
+							trace(ctx, "near_miss", locationName(t))
+							res.notifyAdmin(ctx, renderAdminText(adminNearMiss, adminData{Player: player, Location: locationName(t), Distance: distance}))
+						} else {
+							// the admin heard about it already
+							trace(ctx, "near_miss", locationName(t)+" again")
+						}
+						continue
+					}
+					matches++
+					res.sendText(ctx, chatId, tier.Text)
+					res.notifyAdmin(ctx, renderAdminText(adminChecking, adminData{Player: player, Location: locationName(t), Distance: distance}))
+					res.sendMapPreview(ctx, chatId, l, tier.MaxDistance)
+					res.sendClue(ctx, chatId, t)
+					res.sendLocationPhoto(ctx, chatId, t)
+				}
+			}
+			trace(ctx, "matches", strconv.Itoa(matches))
+		} else {
+			trace(ctx, "matches", "0")
+			res.sendText(ctx, chatId, tier.Text)
+		}
+	} else if update.Message.Sticker.FileId != "" {
+		res.Kind = KindSticker
+		trace(ctx, "branch", "sticker")
+		if REPLY_STICKER != "" {
+			body, err := sendStickerMessage(ctx, chatId, REPLY_STICKER)
+			res.record(Action{Method: "sendSticker", ChatId: chatId, Optional: true, Err: err}, body)
+		} else {
+			res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: update.Message.Sticker.Emoji + " Стикеры не подходят, нужен пароль или локация"}
+		}
+	} else if update.Message.Voice.FileId != "" {
+		res.Kind = KindVoice
+		trace(ctx, "branch", "voice")
+		res.notifyAdmin(ctx, renderAdminText(adminVoice, adminData{Player: player}))
+		text := "Не получилось передать голосовое сообщение организатору"
+		if res.forwardVoice(ctx, update.Message.Voice) {
+			text = "Голосовое сообщение передано организатору"
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: text}
+	} else if update.Message.Audio.FileId != "" {
+		res.Kind = KindAudio
+		trace(ctx, "branch", "audio")
+		res.notifyAdmin(ctx, renderAdminText(adminAudio, adminData{Player: player}))
+		text := "Не получилось передать аудио организатору"
+		if res.forwardAudio(ctx, update.Message.Audio) {
+			text = "Аудио передано организатору"
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: text}
+	} else if command, ok := commandEntity(update.Message); ok {
+		res.Kind = KindCommand
+		trace(ctx, "branch", "unknown_command")
+		text := "Неизвестная команда"
+		if suggestions := suggestCommands(command, chatId == ANTON_CHAT_ID); len(suggestions) > 0 {
+			text += ". Может быть, " + strings.Join(suggestions, " или ") + "?"
+		}
+		res.Reply = &Action{Method: "sendMessage", ChatId: chatId, Text: text}
+	} else {
+		res.Kind = KindPassword
+		trace(ctx, "branch", "wrong_password")
+		res.sendText(ctx, chatId, "Этот пароль не подходит =(")
+		if text, entities, notify := wrongPasswordNotification(player, update.Message); notify {
+			res.notifyAdminWithEntities(ctx, text, entities)
+		}
+	}
+	return res, res.Err()
+}
+
+// parseTelegramRequest handles incoming update from the Telegram web hook
+func parseTelegramRequest(r *http.Request) (*Update, error) {
+	var update Update
+	if rawCapture {
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("could not read incoming update %s", err.Error())
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &update); err != nil {
+			log.Printf("could not decode incoming update %s", err.Error())
+			return nil, err
+		}
+		update.raw = raw
+	} else if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		log.Printf("could not decode incoming update %s", err.Error())
+		return nil, err
+	}
+	if update.UpdateId == 0 {
+		log.Printf("invalid update id, got update id = 0")
+		return nil, errors.New("invalid update id of 0 indicates failure to parse incoming update")
+	}
+	return &update, nil
+}
+
+// Client calls the Telegram Bot API with a bot token. Use NewClient for the production API.
+type Client struct {
+	Token   string
+	BaseURL string
+	HTTP    *http.Client
+	Retry   RetryPolicy
+}
+
+func NewClient(token string) *Client {
+	return &Client{Token: token, BaseURL: telegramApiBaseUrl, HTTP: httpClient, Retry: DefaultRetryPolicy}
+}
+
+// RetryPolicy decides whether and when a call Telegram refused temporarily is repeated: a 429 after the retry_after
+// it asks for, a 5xx after an exponential backoff with jitter. Other errors are never repeated.
+type RetryPolicy struct {
+	// Attempts is the total number of calls made at most, 1 disables retries.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubled for each further one.
+	Backoff time.Duration
+	// MaxWait is the longest wait worth it, a longer retry_after fails the call right away.
+	MaxWait time.Duration
+	// Sleep waits, time.Sleep if nil. Tests replace it to run without real sleeps.
+	Sleep func(time.Duration)
+}
+
+// httpClient is shared by all calls to reuse connections. Its timeout, TELEGRAM_TIMEOUT, bounds a whole call so a hung
+// connection fails it instead of stalling the function until it is killed.
+var httpClient = &http.Client{Timeout: envDuration(telegramTimeoutEnv, 10*time.Second)}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: envInt(telegramRetryAttemptsEnv, 3), Backoff: 500 * time.Millisecond, MaxWait: 10 * time.Second}
+
+// delay returns how long to wait before repeating the call answered with status and body after the given attempt, or
+// false if it must not be repeated.
+func (p RetryPolicy) delay(attempt int, status int, body []byte) (time.Duration, bool) {
+	if attempt >= p.Attempts {
+		return 0, false
+	}
+	var wait time.Duration
+	switch {
+	case status == http.StatusTooManyRequests:
+		var response APIResponse
+		if json.Unmarshal(body, &response) == nil && response.Parameters.RetryAfter > 0 {
+			wait = time.Duration(response.Parameters.RetryAfter) * time.Second
+		} else {
+			wait = p.backoff(attempt)
+		}
+	case status >= http.StatusInternalServerError:
+		wait = p.backoff(attempt)
+	default:
+		return 0, false
+	}
+	if wait > p.MaxWait {
+		return 0, false
+	}
+	return wait, true
+}
+
+// backoff is Backoff doubled for each attempt after the first, with up to half of it randomized away.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff << uint(attempt-1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits d unless ctx is done first, in which case it returns the context error.
+func (p RetryPolicy) sleep(ctx context.Context, d time.Duration) error {
+	if p.Sleep != nil {
+		p.Sleep(d)
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrBudgetExceeded is returned by the send helpers once the daily budget of outbound messages is spent.
+var ErrBudgetExceeded = errors.New("daily send budget exceeded")
+
+// sendBudget caps the messages the send helpers send per UTC day, so a bug looping on sends can't flood players. It
+// counts per warm instance, a cold start begins from zero. Error alerts and HandleEmergencySend post directly and are
+// never held back.
+type sendBudget struct {
+	mu         sync.Mutex
+	day        string
+	sent       int
+	suppressed int
+	limit      int
+	warnAt     int
+	raised     int
+}
+
+var outbound = &sendBudget{limit: envInt(sendBudgetEnv, 1000), warnAt: envInt(sendBudgetWarnEnv, 0)}
+
+// spend counts a send, or refuses it once the limit is reached. The admin is warned through the error alert path when
+// the soft threshold is crossed and when the first send is held back.
+func (b *sendBudget) spend(ctx context.Context, now time.Time) error {
+	b.mu.Lock()
+	b.rollover(now)
+	limit := b.currentLimit()
+	if limit <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.sent >= limit {
+		b.suppressed++
+		first := b.suppressed == 1
+		data := adminData{Count: b.sent, Total: limit}
+		b.mu.Unlock()
+		if first {
+			sendErrorAlert(ctx, renderAdminText(adminBudgetSpent, data))
+		}
+		return ErrBudgetExceeded
+	}
+	b.sent++
+	warnAt := b.warnAt
+	if warnAt <= 0 {
+		warnAt = limit * 8 / 10
+	}
+	warn := b.sent == warnAt
+	data := adminData{Count: b.sent, Total: limit}
+	b.mu.Unlock()
+	if warn {
+		sendErrorAlert(ctx, renderAdminText(adminBudgetWarning, data))
+	}
+	return nil
+}
+
+// raise sets the limit for the rest of the day, after which the configured one applies again.
+func (b *sendBudget) raise(now time.Time, limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(now)
+	b.raised = limit
+	b.suppressed = 0
+}
+
+// status returns the messages sent and held back today and the limit in force.
+func (b *sendBudget) status(now time.Time) (sent int, suppressed int, limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(now)
+	return b.sent, b.suppressed, b.currentLimit()
+}
+
+func (b *sendBudget) rollover(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != b.day {
+		b.day, b.sent, b.suppressed, b.raised = day, 0, 0, 0
+	}
+}
+
+func (b *sendBudget) currentLimit() int {
+	if b.raised > 0 {
+		return b.raised
+	}
+	return b.limit
+}
+
+// DefaultClient, when set, is the client of the send helpers below, e.g. one pointed at a test server. Otherwise they
+// build one from TELEGRAM_BOT_TOKEN on every call, so a rotated token is picked up without a redeploy. Every send
+// helper spends from the outbound budget first.
+var DefaultClient *Client
+
+func defaultClient() *Client {
+	if DefaultClient != nil {
+		return DefaultClient
+	}
+	return NewClient(os.Getenv(telegramTokenEnv))
+}
+
+// sendTextToTelegramChat sends an initial text message to the Telegram chat identified by its chat Id
+func sendTextMessage(ctx context.Context, chatId int, text string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendText(ctx, chatId, text, nil)
+}
+
+func sendTextMessageWithKeyboard(ctx context.Context, chatId int, text string, keyboard map[string][][]map[string]string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendText(ctx, chatId, text, keyboard)
+}
+
+func sendTextMessageWithEntities(ctx context.Context, chatId int, text string, entities []MessageEntity) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendTextWithEntities(ctx, chatId, text, entities)
+}
+
+func sendLocationMessage(ctx context.Context, chatId int, l Location) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendLocation(ctx, chatId, l)
+}
+
+func sendVenueMessage(ctx context.Context, chatId int, l Location, title string, address string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendVenue(ctx, chatId, l, title, address)
+}
+
+func sendPollMessage(ctx context.Context, chatId int, question string, options []string, quiz bool, correctOption int) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendPoll(ctx, chatId, question, options, quiz, correctOption)
+}
+
+func sendStickerMessage(ctx context.Context, chatId int, fileId string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendSticker(ctx, chatId, fileId)
+}
+
+func sendContactMessage(ctx context.Context, chatId int, phone string, firstName string, lastName string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendContact(ctx, chatId, phone, firstName, lastName)
+}
+
+func sendPhotoMessage(ctx context.Context, chatId int, photo string, caption string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendPhoto(ctx, chatId, photo, caption)
+}
+
+func sendDocumentMessage(ctx context.Context, chatId int, filename string, content io.Reader, caption string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendDocument(ctx, chatId, filename, content, caption)
+}
+
+func sendDocumentByIdMessage(ctx context.Context, chatId int, fileId string, caption string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendDocumentById(ctx, chatId, fileId, caption)
+}
+
+func sendVoiceMessage(ctx context.Context, chatId int, fileId string) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendVoice(ctx, chatId, fileId)
+}
+
+func sendAudioMessage(ctx context.Context, chatId int, fileId string, duration int) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendAudio(ctx, chatId, fileId, duration)
+}
+
+func sendLiveLocationMessage(ctx context.Context, chatId int, l Location, livePeriod time.Duration) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().SendLiveLocation(ctx, chatId, l, livePeriod)
+}
+
+func editLiveLocationMessage(ctx context.Context, chatId int, messageId int, l Location) (string, error) {
+	if err := outbound.spend(ctx, time.Now()); err != nil {
+		return "", err
+	}
+	return defaultClient().EditLiveLocation(ctx, chatId, messageId, l)
+}
+
+// SendText sends a text message with an inline keyboard attached, if keyboard is not nil
+func (c *Client) SendText(ctx context.Context, chatId int, text string, keyboard map[string][][]map[string]string) (string, error) {
+	log.Printf("Sending start message to chat_id: %d", chatId);
+
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"text": {TruncateText(text)},
+	}
+	if keyboard != nil {
+		if err := checkInlineKeyboard(keyboard, true); err != nil {
+			log.Printf("refusing to send invalid keyboard: %s", err.Error())
+			return "", err
+		}
+		keyboardStr, err := json.Marshal(keyboard)
+		if err != nil {
+			return "", err
+		}
+		values.Set("reply_markup", string(keyboardStr))
+	}
+	response, err := c.postForm(ctx, telegramApiSendMessage, values)
+	if err != nil {
+		log.Printf("error when posting text to the chat: %s", err.Error())
+		return "", err
+	}
+	defer response.Body.Close()
+	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
+	if errRead != nil {
+		log.Printf("error in parsing telegram answer %s", errRead.Error())
+		return "", err
+	}
+	bodyString := string(bodyBytes)
+	logTelegramResponse(bodyBytes)
+
+	return bodyString, apiError(bodyBytes)
+}
+
+// SendTextWithEntities sends a text message formatted with the entities instead of a parse_mode
+func (c *Client) SendTextWithEntities(ctx context.Context, chatId int, text string, entities []MessageEntity) (string, error) {
+	log.Printf("Sending formatted message to chat_id: %d", chatId);
+
+	entitiesStr, err := json.Marshal(entities)
+	if err != nil {
+		return "", err
+	}
+	response, err := c.postForm(ctx,
+		telegramApiSendMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"text": {TruncateText(text)},
+			"entities": {string(entitiesStr)},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// EditMessageText replaces the text of a message sent by the bot
+func (c *Client) EditMessageText(ctx context.Context, chatId int, messageId int, text string) (string, error) {
+	log.Printf("Editing message %d in chat_id: %d", messageId, chatId);
+
+	response, err := c.postForm(ctx,
+		telegramApiEditMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"message_id": {strconv.Itoa(messageId)},
+			"text": {TruncateText(text)},
+		},
+	)
+	if err != nil {
+		log.Printf("error when editing text in the chat: %s", err.Error())
+		return "", err
+	}
+	defer response.Body.Close()
+	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
+	if errRead != nil {
+		log.Printf("error in parsing telegram answer %s", errRead.Error())
+		return "", err
+	}
+	bodyString := string(bodyBytes)
+	logTelegramResponse(bodyBytes)
+
+	return bodyString, apiError(bodyBytes)
+}
+
+// WebhookInfo is the webhook registration as reported by getWebhookInfo.
+type WebhookInfo struct {
+	Url                string `json:"url"`
+	PendingUpdateCount int    `json:"pending_update_count"`
+	LastErrorDate      int64  `json:"last_error_date"`
+	LastErrorMessage   string `json:"last_error_message"`
+}
+
+// GetMe returns the username of the bot, which proves the token is valid.
+func (c *Client) GetMe(ctx context.Context) (string, error) {
+	var me User
+	if err := c.getResult(ctx, telegramApiGetMe, &me); err != nil {
+		return "", err
+	}
+	return me.Username, nil
+}
+
+// GetWebhookInfo returns the current webhook registration.
+func (c *Client) GetWebhookInfo(ctx context.Context) (WebhookInfo, error) {
+	var info WebhookInfo
+	err := c.getResult(ctx, telegramApiGetWebhookInfo, &info)
+	return info, err
+}
+
+// getResult calls a method without parameters and decodes its result. Unlike the send helpers it is not captured.
+func (c *Client) getResult(ctx context.Context, method string, result interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+c.Token+method, nil)
+	if err != nil {
+		return err
+	}
+	client := c.HTTP
+	if client == nil {
+		client = httpClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return redactError(err, c.Token)
+	}
+	defer response.Body.Close()
+	var body APIResponse
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return err
+	}
+	if !body.Ok {
+		return fmt.Errorf("telegram error %d: %s", body.ErrorCode, body.Description)
+	}
+	return json.Unmarshal(body.Result, result)
+}
+
+// SendLocation sends a clue location
+func (c *Client) SendLocation(ctx context.Context, chatId int, l Location) (string, error) {
+	log.Printf("Sending location message to chat_id: %d", chatId);
+
+	response, err := c.postForm(ctx,
+		telegramSendLocationMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"longitude": {formatCoordinate(l.Longitude)},
+			"latitude": {formatCoordinate(l.Latitude)},
+			"horizontal_accuracy": {"2"},
+		},
+	)
+
+	if err != nil {
+		log.Printf("error when posting text to the chat: %s", err.Error())
+		return "", err
+	}
+	defer response.Body.Close()
+	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
+	if errRead != nil {
+		log.Printf("error in parsing telegram answer %s", errRead.Error())
+		return "", err
+	}
+	bodyString := string(bodyBytes)
+	logTelegramResponse(bodyBytes)
+
+	return bodyString, apiError(bodyBytes)
+}
+
+// SendVenue sends a location labeled with a title and an address
+func (c *Client) SendVenue(ctx context.Context, chatId int, l Location, title string, address string) (string, error) {
+	log.Printf("Sending venue message to chat_id: %d", chatId);
+
+	response, err := c.postForm(ctx,
+		telegramSendVenueMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"longitude": {formatCoordinate(l.Longitude)},
+			"latitude": {formatCoordinate(l.Latitude)},
+			"title": {title},
+			"address": {address},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// SendPoll sends a non-anonymous poll, a quiz with correctOption as the right answer if quiz is set. Answers arrive as
+// poll_answer updates, which the webhook only gets when allowed_updates includes them.
+func (c *Client) SendPoll(ctx context.Context, chatId int, question string, options []string, quiz bool, correctOption int) (string, error) {
+	log.Printf("Sending poll to chat_id: %d", chatId);
+
+	optionsStr, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"question": {question},
+		"options": {string(optionsStr)},
+		"is_anonymous": {"false"},
+		"type": {"regular"},
+	}
+	if quiz {
+		values.Set("type", "quiz")
+		values.Set("correct_option_id", strconv.Itoa(correctOption))
+	}
+	response, err := c.postForm(ctx, telegramSendPollMessage, values)
+	return readSendResponse(response, err)
+}
+
+// SendSticker sends a sticker given by file_id
+func (c *Client) SendSticker(ctx context.Context, chatId int, fileId string) (string, error) {
+	log.Printf("Sending sticker to chat_id: %d", chatId);
+
+	response, err := c.postForm(ctx,
+		telegramSendStickerMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"sticker": {fileId},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// SendContact sends a contact card, the last name is optional
+func (c *Client) SendContact(ctx context.Context, chatId int, phone string, firstName string, lastName string) (string, error) {
+	log.Printf("Sending contact message to chat_id: %d", chatId);
+
+	if err := checkContact(phone, firstName); err != nil {
+		log.Printf("refusing to send contact: %s", err.Error())
+		return "", err
+	}
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"phone_number": {phone},
+		"first_name": {firstName},
+	}
+	if lastName != "" {
+		values.Set("last_name", lastName)
+	}
+	response, err := c.postForm(ctx, telegramSendContactMessage, values)
+	return readSendResponse(response, err)
+}
+
+// formatCoordinate formats a latitude or longitude in plain decimal notation with as many digits as needed.
+func formatCoordinate(x float64) string {
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
+
+// SendPhoto sends a photo given by file_id, URL or the path of a local file, which is uploaded, with an optional caption
+func (c *Client) SendPhoto(ctx context.Context, chatId int, photo string, caption string) (string, error) {
+	log.Printf("Sending photo message to chat_id: %d", chatId);
+
+	if err := checkCaption(caption); err != nil {
+		log.Printf("refusing to send photo: %s", err.Error())
+		return "", err
+	}
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"caption": {caption},
+	}
+	var response *http.Response
+	var err error
+	if isLocalFile(photo) {
+		var file *os.File
+		if file, err = os.Open(photo); err != nil {
+			log.Printf("error when opening photo: %s", err.Error())
+			return "", err
+		}
+		defer file.Close()
+		response, err = c.postMultipart(ctx, telegramSendPhotoMessage, values, "photo", filepath.Base(photo), file)
+	} else {
+		values.Set("photo", photo)
+		response, err = c.postForm(ctx, telegramSendPhotoMessage, values)
+	}
+	return readSendResponse(response, err)
+}
+// SendDocument uploads content as a file named filename with an optional caption
+func (c *Client) SendDocument(ctx context.Context, chatId int, filename string, content io.Reader, caption string) (string, error) {
+	log.Printf("Sending document %s to chat_id: %d", filename, chatId);
+
+	if err := checkCaption(caption); err != nil {
+		log.Printf("refusing to send document: %s", err.Error())
+		return "", err
+	}
+	response, err := c.postMultipart(ctx,
+		telegramSendDocumentMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"caption": {caption},
+		},
+		"document",
+		filename,
+		content,
+	)
+	return readSendResponse(response, err)
+}
+
+// SendDocumentById sends again a document Telegram already has, given by file_id, or one given by URL
+func (c *Client) SendDocumentById(ctx context.Context, chatId int, fileId string, caption string) (string, error) {
+	log.Printf("Sending document %s to chat_id: %d", fileId, chatId);
+
+	if err := checkCaption(caption); err != nil {
+		log.Printf("refusing to send document: %s", err.Error())
+		return "", err
+	}
+	response, err := c.postForm(ctx,
+		telegramSendDocumentMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"document": {fileId},
+			"caption": {caption},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// SendVoice sends a voice note given by file_id, e.g. one received from a player
+func (c *Client) SendVoice(ctx context.Context, chatId int, fileId string) (string, error) {
+	log.Printf("Sending voice message to chat_id: %d", chatId);
+
+	response, err := c.postForm(ctx,
+		telegramSendVoiceMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"voice": {fileId},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// SendAudio sends an audio file given by file_id, with its duration in seconds if known
+func (c *Client) SendAudio(ctx context.Context, chatId int, fileId string, duration int) (string, error) {
+	log.Printf("Sending audio message to chat_id: %d", chatId);
+
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"audio": {fileId},
+	}
+	if duration > 0 {
+		values.Set("duration", strconv.Itoa(duration))
+	}
+	response, err := c.postForm(ctx, telegramSendAudioMessage, values)
+	return readSendResponse(response, err)
+}
+
+// readSendResponse reads the answer to a send method into its body and the Telegram error it holds, if any.
+func readSendResponse(response *http.Response, err error) (string, error) {
+	if err != nil {
+		log.Printf("error when posting to the chat: %s", err.Error())
+		return "", err
+	}
+	defer response.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Printf("error in parsing telegram answer %s", err.Error())
+		return "", err
+	}
+	logTelegramResponse(bodyBytes)
+
+	return string(bodyBytes), apiError(bodyBytes)
+}
+
+// postForm posts the values to the Telegram API and captures the call for /lastcalls. The response body is read
+// upfront to be captured and handed back unread.
+func (c *Client) postForm(ctx context.Context, method string, values url.Values) (*http.Response, error) {
+	payload := values.Encode()
+	return c.post(ctx, method, "application/x-www-form-urlencoded", []byte(payload), payload)
+}
+
+// postMultipart is postForm uploading content as the file filename in field, for methods taking an InputFile. Only the
+// name of the file is captured.
+func (c *Client) postMultipart(ctx context.Context, method string, values url.Values, field string, filename string, content io.Reader) (*http.Response, error) {
+	var payload bytes.Buffer
+	writer := multipart.NewWriter(&payload)
+	for key, vs := range values {
+		for _, v := range vs {
+			writer.WriteField(key, v)
+		}
+	}
+	part, err := writer.CreateFormFile(field, filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	captured := url.Values{field: {"@" + filename}}
+	for key, vs := range values {
+		captured[key] = vs
+	}
+	return c.post(ctx, method, writer.FormDataContentType(), payload.Bytes(), captured.Encode())
+}
+
+// post sends the payload, retrying as the policy of the client allows. captured is what /lastcalls shows of it.
+func (c *Client) post(ctx context.Context, method string, contentType string, payload []byte, captured string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		response, body, err := c.postOnce(ctx, method, contentType, payload, captured)
+		if err != nil {
+			return nil, err
+		}
+		wait, retry := c.Retry.delay(attempt, response.StatusCode, body)
+		if !retry {
+			return response, nil
+		}
+		log.Printf("telegram answered %s to %s, retrying in %s", response.Status, method, wait)
+		if err := c.Retry.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// postOnce makes a single call, see post.
+func (c *Client) postOnce(ctx context.Context, method string, contentType string, payload []byte, captured string) (*http.Response, []byte, error) {
+	start := time.Now()
+	if err := token.check(start); err != nil {
+		return nil, nil, err
+	}
+	apiUrl := c.BaseURL + c.Token + method
+	client := c.HTTP
+	if client == nil {
+		client = httpClient
+	}
+	var response *http.Response
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, bytes.NewReader(payload))
+	if err == nil {
+		request.Header.Set("Content-Type", contentType)
+		response, err = client.Do(request)
+	}
+	call := outboundCall{
+		At:       start,
+		Method:   strings.TrimPrefix(method, "/"),
+		URL:      redactToken(apiUrl, c.Token),
+		Request:  truncateForLog(redactToken(captured, c.Token), callCaptureBodyMaxLength),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		err = redactError(err, c.Token)
+		call.Err = err.Error()
+		lastCalls.add(call)
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		err = redactError(err, c.Token)
+	}
+	response.Body.Close()
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	call.Status = response.StatusCode
+	call.Response = truncateForLog(redactToken(string(body), c.Token), callCaptureBodyMaxLength)
+	call.Duration = time.Since(start)
+	if err == nil && response.StatusCode == http.StatusUnauthorized {
+		err = ErrUnauthorized
+		if token.unauthorized(time.Now()) {
+			text := renderAdminText(adminTokenRejected, adminData{Text: telegramTokenEnv})
+			dispatchAlert(ctx, func() { sendSideChannelAlert(text) })
+		}
+	} else if err == nil && token.authorized() {
+		log.Printf("telegram accepts the bot token again")
+	}
+	if err != nil {
+		call.Err = err.Error()
+		lastCalls.add(call)
+		return nil, nil, err
+	}
+	lastCalls.add(call)
+	return response, body, nil
+}
+
+// telegramMessageId returns the id of the message a Telegram call sent or edited, or the error Telegram answered with.
+func telegramMessageId(body string) (int, error) {
+	var response APIResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return 0, err
+	}
+	if !response.Ok {
+		return 0, fmt.Errorf("telegram error %d: %s", response.ErrorCode, response.Description)
+	}
+	var result struct {
+		MessageId int `json:"message_id"`
+	}
+	json.Unmarshal(response.Result, &result)
+	return result.MessageId, nil
+}
+
+// telegramPollId returns the id of the poll a sendPoll call created.
+func telegramPollId(body string) (string, error) {
+	var response APIResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		return "", err
+	}
+	var result struct {
+		Poll struct {
+			Id string `json:"id"`
+		} `json:"poll"`
+	}
+	if err := json.Unmarshal(response.Result, &result); err != nil {
+		return "", err
+	}
+	if result.Poll.Id == "" {
+		return "", errors.New("no poll in the answer of telegram")
+	}
+	return result.Poll.Id, nil
+}
+
+// SendLiveLocation sends a location which can be edited during the live period
+func (c *Client) SendLiveLocation(ctx context.Context, chatId int, l Location, livePeriod time.Duration) (string, error) {
+	log.Printf("Sending live location message to chat_id: %d", chatId);
+
+	response, err := c.postForm(ctx,
+		telegramSendLocationMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"longitude": {formatCoordinate(l.Longitude)},
+			"latitude": {formatCoordinate(l.Latitude)},
+			"live_period": {strconv.Itoa(int(livePeriod.Seconds()))},
+		},
+	)
+	return readSendResponse(response, err)
+}
+
+// EditLiveLocation moves a live location sent by SendLiveLocation
+func (c *Client) EditLiveLocation(ctx context.Context, chatId int, messageId int, l Location) (string, error) {
+	log.Printf("Editing live location message %d in chat_id: %d", messageId, chatId);
+
+	response, err := c.postForm(ctx,
+		telegramEditLiveLocationMessage,
+		url.Values{
+			"chat_id": {strconv.Itoa(chatId)},
+			"message_id": {strconv.Itoa(messageId)},
+			"longitude": {formatCoordinate(l.Longitude)},
+			"latitude": {formatCoordinate(l.Latitude)},
+		},
+	)
+	return readSendResponse(response, err)
+}
@@ -3,15 +3,20 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Pass token and sensible APIs through environment variables
@@ -19,9 +24,21 @@ const telegramApiBaseUrl string = "https://api.telegram.org/bot"
 const telegramApiSendMessage string = "/sendMessage"
 const telegramTokenEnv string = "TELEGRAM_BOT_TOKEN"
 const telegramApiEditMessage string = "/editMessageText"
+const telegramApiAnswerCallbackQuery string = "/answerCallbackQuery"
+const logDebugEnv string = "LOG_DEBUG"
+const logBodyMaxLengthEnv string = "LOG_BODY_MAX_LENGTH"
+const telegramRetryAttemptsEnv string = "TELEGRAM_RETRY_ATTEMPTS"
+const telegramTimeoutEnv string = "TELEGRAM_TIMEOUT"
 
-var telegramApiSend string = telegramApiBaseUrl + os.Getenv(telegramTokenEnv) + telegramApiSendMessage
-var telegramApiEdit string = telegramApiBaseUrl + os.Getenv(telegramTokenEnv) + telegramApiEditMessage
+var logDebug bool = os.Getenv(logDebugEnv) == "true"
+var logBodyMaxLength int = envInt(logBodyMaxLengthEnv, 1024)
+
+// Benign errors Telegram returns for edits that did not need to happen. They are logged as warnings only.
+var ErrMessageNotModified = errors.New("message is not modified")
+var ErrQueryTooOld = errors.New("query is too old")
+var ErrMessageToEditNotFound = errors.New("message to edit not found")
+
+var benignEditErrors = [...]error{ErrMessageNotModified, ErrQueryTooOld, ErrMessageToEditNotFound}
 
 // Update is a Telegram object that we receive every time an user interacts with the bot.
 type Update struct {
@@ -103,6 +120,206 @@ func (c Chat) String() string {
 	return fmt.Sprintf("(id: %d)", c.Id)
 }
 
+// APIResponse is the envelope Telegram wraps every answer in.
+type APIResponse struct {
+	Ok          bool            `json:"ok"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// TelegramError is an answer with ok=false, e.g. 403 "Forbidden: bot was blocked by the user".
+type TelegramError struct {
+	Code        int
+	Description string
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("telegram error %d: %s", e.Code, e.Description)
+}
+
+// apiError returns a *TelegramError if Telegram refused the call answered with body.
+func apiError(body []byte) error {
+	var response APIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("could not decode telegram response: %w", err)
+	}
+	if !response.Ok {
+		return &TelegramError{Code: response.ErrorCode, Description: response.Description}
+	}
+	return nil
+}
+
+// Is matches the benign sentinel errors by their description, so errors.Is tells a benign edit failure.
+func (e *TelegramError) Is(target error) bool {
+	for _, benign := range benignEditErrors {
+		if target == benign {
+			return strings.Contains(e.Description, benign.Error())
+		}
+	}
+	return false
+}
+
+// logTelegramResponse logs the outcome of a Telegram call. The full body is only logged in debug mode, and even then
+// truncated, since keyboard-bearing answers are large and logging them on every call is costly.
+func logTelegramResponse(body []byte) {
+	var response APIResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Printf("could not decode telegram response: %s", err.Error())
+	} else if response.Ok {
+		var result struct {
+			MessageId int `json:"message_id"`
+		}
+		json.Unmarshal(response.Result, &result)
+		log.Printf("Telegram response: ok, message_id %d", result.MessageId)
+	} else {
+		log.Printf("Telegram response: error %d, %s", response.ErrorCode, response.Description)
+	}
+	if logDebug {
+		log.Printf("Body of Telegram Response: %s", truncateForLog(string(body), logBodyMaxLength))
+	}
+}
+
+// truncateForLog cuts s to at most max bytes without splitting a UTF-8 sequence and marks how much was dropped.
+func truncateForLog(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s…(%d more bytes)", s[:cut], len(s)-cut)
+}
+
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Telegram limits on what the bot sends, in characters except for callback data which is limited in bytes.
+const MaxTextLength int = 4096
+const MaxCaptionLength int = 1024
+const MaxToastLength int = 200
+const MaxCallbackDataBytes int = 64
+
+// Ellipsis marks a text cut by one of the Truncate helpers.
+var Ellipsis string = "…"
+
+// TruncateText cuts a message text to the Telegram limit. The bot sends no parse_mode, so there are no entities to
+// keep intact.
+func TruncateText(s string) string {
+	return truncateRunes(s, MaxTextLength)
+}
+
+// TruncateCaption cuts a media caption to the Telegram limit.
+func TruncateCaption(s string) string {
+	return truncateRunes(s, MaxCaptionLength)
+}
+
+// TruncateToast cuts the text of an answerCallbackQuery notification to the Telegram limit.
+func TruncateToast(s string) string {
+	return truncateRunes(s, MaxToastLength)
+}
+
+// TruncateCallbackData cuts callback data to the byte limit on a rune boundary. There is no ellipsis, the data is
+// read back by the bot rather than by a person.
+func TruncateCallbackData(s string) string {
+	if len(s) <= MaxCallbackDataBytes {
+		return s
+	}
+	cut := MaxCallbackDataBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// truncateRunes cuts s to at most max characters, the Ellipsis included, never splitting a multi-byte character.
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	keep := max - utf8.RuneCountInString(Ellipsis)
+	if keep < 0 {
+		keep = 0
+	}
+	n := 0
+	for i := range s {
+		if n == keep {
+			return s[:i] + Ellipsis
+		}
+		n++
+	}
+	return s
+}
+
+// Limits Telegram puts on inline keyboards. Violations come back as opaque 400s, so we check before sending.
+const maxKeyboardButtons int = 100
+const maxKeyboardRowButtons int = 8
+const maxButtonTextLength int = 64
+
+// checkInlineKeyboard validates an inline keyboard against Telegram's limits and returns an error naming the offending
+// button. With autoWrap, rows longer than the per-row limit are split into several rows instead of being rejected.
+func checkInlineKeyboard(keyboard map[string][][]map[string]string, autoWrap bool) error {
+	rows := keyboard["inline_keyboard"]
+	if autoWrap {
+		var wrapped [][]map[string]string
+		for _, row := range rows {
+			for len(row) > maxKeyboardRowButtons {
+				wrapped = append(wrapped, row[:maxKeyboardRowButtons])
+				row = row[maxKeyboardRowButtons:]
+			}
+			wrapped = append(wrapped, row)
+		}
+		rows = wrapped
+		keyboard["inline_keyboard"] = rows
+	}
+
+	total := 0
+	for i, row := range rows {
+		if len(row) > maxKeyboardRowButtons {
+			return fmt.Errorf("keyboard row %d has %d buttons, at most %d are allowed", i, len(row), maxKeyboardRowButtons)
+		}
+		for j, button := range row {
+			if n := utf8.RuneCountInString(button["text"]); n == 0 || n > maxButtonTextLength {
+				return fmt.Errorf("button %q (row %d, column %d) has text of %d characters, 1 to %d are allowed", button["text"], i, j, n, maxButtonTextLength)
+			}
+			if data, ok := button["callback_data"]; ok && (len(data) == 0 || len(data) > MaxCallbackDataBytes) {
+				return fmt.Errorf("button %q (row %d, column %d) has callback data of %d bytes, 1 to %d are allowed", button["text"], i, j, len(data), MaxCallbackDataBytes)
+			}
+		}
+		total += len(row)
+	}
+	if total > maxKeyboardButtons {
+		return fmt.Errorf("keyboard has %d buttons, at most %d are allowed", total, maxKeyboardButtons)
+	}
+	return nil
+}
+
+func isBenignEditError(err error) bool {
+	for _, benign := range benignEditErrors {
+		if errors.Is(err, benign) {
+			return true
+		}
+	}
+	return false
+}
+
 var CELEBRATIONS = [...]string {
 "Твой друг: Дрюня\nНа вопрос: Что бы ты приготовил/а Маше на завтрак?\nОтветил(а): Пельмеши",
 }
@@ -129,20 +346,36 @@ func HandleTelegramWebHook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if (update.Message.Text == "/start") {
-		var telegramResponseBody, errTelegram = sendStartTextMessage(update.Message.Chat.Id, "Привет, нажимай на кнопку получить поздравление и кайфуй!")
+		var telegramResponseBody, errTelegram = sendStartTextMessage(r.Context(), update.Message.Chat.Id, "Привет, нажимай на кнопку получить поздравление и кайфуй!")
 		if errTelegram != nil {
 			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
 		} else {
 			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
 		}
-	} else if (isAllowed(update.CallbackQuerry.From.Username)) {
-		p, _ := strconv.Atoi(update.CallbackQuerry.Data);
-
-		var telegramResponseBody, errTelegram = sendCelebrateMessage(update.CallbackQuerry.Message.Chat.Id, update.CallbackQuerry.Message.Id, p);
-		if errTelegram != nil {
+	} else if (update.CallbackQuerry.Id != "") {
+		// Every press is answered exactly once, otherwise the button keeps spinning until Telegram gives up
+		toast := ""
+		if (isAllowed(update.CallbackQuerry.From.Username)) {
+			p, _ := strconv.Atoi(update.CallbackQuerry.Data);
+
+			var telegramResponseBody, errTelegram = sendCelebrateMessage(r.Context(), update.CallbackQuerry.Message.Chat.Id, update.CallbackQuerry.Message.Id, p);
+			if isBenignEditError(errTelegram) {
+				log.Printf("warning: %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
+				if errors.Is(errTelegram, ErrMessageNotModified) {
+					// Same text and keyboard as before, let the user know the button did work
+					toast = "Это все поздравления на сегодня!"
+				}
+			} else if errTelegram != nil {
+				log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
+			} else {
+				log.Printf("successfully distributed to chat id %d", update.CallbackQuerry.Message.Chat.Id)
+			}
+		}
+		var telegramResponseBody, errTelegram = answerCallbackQuery(r.Context(), update.CallbackQuerry.Id, toast, false)
+		if errors.Is(errTelegram, ErrQueryTooOld) {
+			log.Printf("warning: %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
+		} else if errTelegram != nil {
 			log.Printf("got error %s from telegram, response body is %s", errTelegram.Error(), telegramResponseBody)
-		} else {
-			log.Printf("successfully distributed to chat id %d", update.Message.Chat.Id)
 		}
 	}
 	log.Printf("Update new is %s", update);
@@ -162,77 +395,260 @@ func parseTelegramRequest(r *http.Request) (*Update, error) {
 	return &update, nil
 }
 
-// sendTextToTelegramChat sends an initial text message to the Telegram chat identified by its chat Id
-func sendStartTextMessage(chatId int, text string) (string, error) {
-	log.Printf("Sending start message to chat_id: %d", chatId);
+// Client calls the Telegram Bot API with a bot token. Use NewClient for the production API.
+type Client struct {
+	Token   string
+	BaseURL string
+	HTTP    *http.Client
+	Retry   RetryPolicy
+}
 
-	keyboard := make(map[string][][]map[string]string)
-	var fo = []map[string]string{}
-	fo = append(fo, map[string]string {"text": "Получить поздравление", "callback_data": "0"})
-	keyboard["inline_keyboard"] = [][]map[string]string{fo}
+func NewClient(token string) *Client {
+	return &Client{Token: token, BaseURL: telegramApiBaseUrl, HTTP: httpClient, Retry: DefaultRetryPolicy}
+}
 
-    keyboardStr, err := json.Marshal(keyboard)
-	response, err := http.PostForm(
-		telegramApiSend,
-		url.Values{
-			"chat_id": {strconv.Itoa(chatId)},
-			"text": {text},
-			"reply_markup": {string(keyboardStr)},
-		},
-	)
-	if err != nil {
-		log.Printf("error when posting text to the chat: %s", err.Error())
-		return "", err
+// RetryPolicy decides whether and when a call Telegram refused temporarily is repeated: a 429 after the retry_after
+// it asks for, a 5xx after an exponential backoff with jitter. Other errors are never repeated.
+type RetryPolicy struct {
+	// Attempts is the total number of calls made at most, 1 disables retries.
+	Attempts int
+	// Backoff is the wait before the second attempt, doubled for each further one.
+	Backoff time.Duration
+	// MaxWait is the longest wait worth it, a longer retry_after fails the call right away.
+	MaxWait time.Duration
+	// Sleep waits, time.Sleep if nil. Tests replace it to run without real sleeps.
+	Sleep func(time.Duration)
+}
+
+// httpClient is shared by all calls to reuse connections. Its timeout, TELEGRAM_TIMEOUT, bounds a whole call so a hung
+// connection fails it instead of stalling the function until it is killed.
+var httpClient = &http.Client{Timeout: envDuration(telegramTimeoutEnv, 10*time.Second)}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: envInt(telegramRetryAttemptsEnv, 3), Backoff: 500 * time.Millisecond, MaxWait: 10 * time.Second}
+
+// delay returns how long to wait before repeating the call answered with status and body after the given attempt, or
+// false if it must not be repeated.
+func (p RetryPolicy) delay(attempt int, status int, body []byte) (time.Duration, bool) {
+	if attempt >= p.Attempts {
+		return 0, false
 	}
-	defer response.Body.Close()
-	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
-	if errRead != nil {
-		log.Printf("error in parsing telegram answer %s", errRead.Error())
-		return "", err
+	var wait time.Duration
+	switch {
+	case status == http.StatusTooManyRequests:
+		var response APIResponse
+		if json.Unmarshal(body, &response) == nil && response.Parameters.RetryAfter > 0 {
+			wait = time.Duration(response.Parameters.RetryAfter) * time.Second
+		} else {
+			wait = p.backoff(attempt)
+		}
+	case status >= http.StatusInternalServerError:
+		wait = p.backoff(attempt)
+	default:
+		return 0, false
 	}
-	bodyString := string(bodyBytes)
-	log.Printf("Body of Telegram Response: %s", bodyString)
+	if wait > p.MaxWait {
+		return 0, false
+	}
+	return wait, true
+}
 
-	return bodyString, nil
+// backoff is Backoff doubled for each attempt after the first, with up to half of it randomized away.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff << uint(attempt-1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits d unless ctx is done first, in which case it returns the context error.
+func (p RetryPolicy) sleep(ctx context.Context, d time.Duration) error {
+	if p.Sleep != nil {
+		p.Sleep(d)
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DefaultClient, when set, is the client of the send helpers below, e.g. one pointed at a test server. Otherwise they
+// build one from TELEGRAM_BOT_TOKEN on every call, so a rotated token is picked up without a redeploy.
+var DefaultClient *Client
+
+func defaultClient() *Client {
+	if DefaultClient != nil {
+		return DefaultClient
+	}
+	return NewClient(os.Getenv(telegramTokenEnv))
+}
+
+// celebrateKeyboard is the single button asking for the celebration p
+func celebrateKeyboard(p int) map[string][][]map[string]string {
+	keyboard := make(map[string][][]map[string]string)
+	var fo = []map[string]string{}
+	fo = append(fo, map[string]string {"text": "Получить поздравление", "callback_data": strconv.Itoa(p)})
+	keyboard["inline_keyboard"] = [][]map[string]string{fo}
+	return keyboard
 }
 
 // sendTextToTelegramChat sends an initial text message to the Telegram chat identified by its chat Id
-func sendCelebrateMessage(chatId int, messageId int, p int) (string, error) {
-	log.Printf("Sending start message to chat_id: %d", chatId);
+func sendStartTextMessage(ctx context.Context, chatId int, text string) (string, error) {
+	return defaultClient().SendText(ctx, chatId, text, celebrateKeyboard(0))
+}
 
+// sendCelebrateMessage replaces the message with the celebration p and a button for the next one
+func sendCelebrateMessage(ctx context.Context, chatId int, messageId int, p int) (string, error) {
 	text := CELEBRATIONS[p];
 	p += 1;
 	if (p == len(CELEBRATIONS)) {
 		p = 0;
 	}
 
-	keyboard := make(map[string][][]map[string]string)
-	var fo = []map[string]string{}
-	fo = append(fo, map[string]string {"text": "Получить поздравление", "callback_data": strconv.Itoa(p)})
-	keyboard["inline_keyboard"] = [][]map[string]string{fo}
+	return defaultClient().EditMessageText(ctx, chatId, messageId, text, celebrateKeyboard(p))
+}
 
-    keyboardStr, err := json.Marshal(keyboard)
-	response, err := http.PostForm(
-		telegramApiEdit,
-		url.Values{
-			"chat_id": {strconv.Itoa(chatId)},
-			"message_id": {strconv.Itoa(messageId)},
-			"text": {text},
-			"reply_markup": {string(keyboardStr)},
-		},
-	)
-	if err != nil {
-		log.Printf("error when posting text to the chat: %s", err.Error())
-		return "", err
+// answerCallbackQuery stops the spinner on the pressed button, optionally showing a toast or an alert with text.
+func answerCallbackQuery(ctx context.Context, callbackId string, text string, showAlert bool) (string, error) {
+	return defaultClient().AnswerCallbackQuery(ctx, callbackId, text, showAlert)
+}
+
+// SendText sends a text message with an inline keyboard attached, if keyboard is not nil
+func (c *Client) SendText(ctx context.Context, chatId int, text string, keyboard map[string][][]map[string]string) (string, error) {
+	log.Printf("Sending start message to chat_id: %d", chatId);
+
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"text": {TruncateText(text)},
+	}
+	if keyboard != nil {
+		if err := checkInlineKeyboard(keyboard, true); err != nil {
+			log.Printf("refusing to send invalid keyboard: %s", err.Error())
+			return "", err
+		}
+		keyboardStr, err := json.Marshal(keyboard)
+		if err != nil {
+			return "", err
+		}
+		values.Set("reply_markup", string(keyboardStr))
+	}
+	return c.postForm(ctx, telegramApiSendMessage, values)
+}
+
+// EditMessageText replaces the text and the inline keyboard, if keyboard is not nil, of a message sent by the bot
+func (c *Client) EditMessageText(ctx context.Context, chatId int, messageId int, text string, keyboard map[string][][]map[string]string) (string, error) {
+	log.Printf("Editing message %d in chat_id: %d", messageId, chatId);
+
+	values := url.Values{
+		"chat_id": {strconv.Itoa(chatId)},
+		"message_id": {strconv.Itoa(messageId)},
+		"text": {TruncateText(text)},
 	}
-	defer response.Body.Close()
-	var bodyBytes, errRead = ioutil.ReadAll(response.Body)
-	if errRead != nil {
-		log.Printf("error in parsing telegram answer %s", errRead.Error())
-		return "", err
+	if keyboard != nil {
+		if err := checkInlineKeyboard(keyboard, true); err != nil {
+			log.Printf("refusing to send invalid keyboard: %s", err.Error())
+			return "", err
+		}
+		keyboardStr, err := json.Marshal(keyboard)
+		if err != nil {
+			return "", err
+		}
+		values.Set("reply_markup", string(keyboardStr))
+	}
+	return c.postForm(ctx, telegramApiEditMessage, values)
+}
+
+// AnswerCallbackQuery stops the spinner on the pressed button, optionally showing a toast or an alert with text.
+func (c *Client) AnswerCallbackQuery(ctx context.Context, callbackId string, text string, showAlert bool) (string, error) {
+	log.Printf("Answering callback query: %s", callbackId);
+
+	values := url.Values{
+		"callback_query_id": {callbackId},
+		"show_alert": {strconv.FormatBool(showAlert)},
+	}
+	if text != "" {
+		values.Set("text", TruncateToast(text))
+	}
+	return c.postForm(ctx, telegramApiAnswerCallbackQuery, values)
+}
+
+// redactToken removes the bot token from s.
+func redactToken(s string, secret string) string {
+	if secret != "" {
+		return strings.ReplaceAll(s, secret, "<token>")
+	}
+	return s
+}
+
+// redactedError is an error whose message had the bot token removed. It unwraps to the cause of a *url.Error, which
+// has no URL in it, so errors.Is still tells e.g. a cancelled context.
+type redactedError struct {
+	message string
+	cause   error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.cause
+}
+
+// redactError returns err with the bot token removed from its message, as the errors of the HTTP client quote the
+// request URL and they end up in the logs.
+func redactError(err error, secret string) error {
+	var cause error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		cause = urlErr.Err
+	}
+	return &redactedError{message: redactToken(err.Error(), secret), cause: cause}
+}
+
+// postForm calls the API method with the values and returns the body of the answer
+func (c *Client) postForm(ctx context.Context, method string, values url.Values) (string, error) {
+	client := c.HTTP
+	if client == nil {
+		client = httpClient
+	}
+	var bodyBytes []byte
+	for attempt := 1; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+c.Token+method, strings.NewReader(values.Encode()))
+		if err != nil {
+			return "", redactError(err, c.Token)
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err := client.Do(request)
+		if err != nil {
+			err = redactError(err, c.Token)
+			log.Printf("error when posting %s to the chat: %s", method, err.Error())
+			return "", err
+		}
+		var errRead error
+		bodyBytes, errRead = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if errRead != nil {
+			errRead = redactError(errRead, c.Token)
+			log.Printf("error in parsing telegram answer %s", errRead.Error())
+			return "", errRead
+		}
+		wait, retry := c.Retry.delay(attempt, response.StatusCode, bodyBytes)
+		if !retry {
+			break
+		}
+		log.Printf("telegram answered %s to %s, retrying in %s", response.Status, method, wait)
+		if err := c.Retry.sleep(ctx, wait); err != nil {
+			return "", err
+		}
 	}
 	bodyString := string(bodyBytes)
-	log.Printf("Body of Telegram Response: %s", bodyString)
+	logTelegramResponse(bodyBytes)
 
-	return bodyString, nil
-}
\ No newline at end of file
+	return bodyString, apiError(bodyBytes)
+}